@@ -1,80 +1,98 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"pumago/content"
+	"pumago/events"
 	"pumago/index"
+	"pumago/ingest"
+	"pumago/scheduler"
 	"pumago/server"
 	"time"
 )
 
 type App struct {
-	Index            index.Index
-	DB               content.DB
-	Sources          []content.Source
-	ContentQueue     chan content.Content
-	ScrapeEvery      time.Duration
-	CompletionQueues map[string]chan content.Content
-	WebServer        server.WebServer
+	Index        index.Index
+	DB           content.DB
+	Sources      []content.Source
+	ContentQueue chan content.Content
+	Pipeline     *ingest.Pipeline
+	Scheduler    *scheduler.Scheduler
+	Events       *events.Bus
+	WebServer    server.WebServer
+	// ChatRetention is how long stored conversations are kept, 0 keeps them forever.
+	ChatRetention time.Duration
 }
 
-func (app *App) StartSource(source content.Source) {
-	app.processSource(source)
-	ticker := time.NewTicker(app.ScrapeEvery)
+// processSource fetches a source once, it is the scheduler's RunFunc.
+func (app *App) processSource(source content.Source) (int, error) {
+	space := content.StateSpace(source)
+	log.Printf("Fetching content from %s", space)
+	settings, err := app.DB.LoadSettings(space)
+	if err != nil {
+		log.Printf("Failed to load settings: %v", err)
+		return 0, err
+	}
+	contents, fetchErr := source.FetchContent(settings)
+	if fetchErr != nil {
+		log.Printf("Failed to fetch contents: %v from source %s", fetchErr, space)
+	}
+	for i := range contents {
+		contents[i] = contents[i].Shrink()
+	}
+	if err := app.Pipeline.Persist(contents); err != nil {
+		// without the state saved the next run fetches them again
+		log.Printf("Failed to persist contents from source %s: %v", space, err)
+		return 0, err
+	}
+	// partial results (e.g. from a crashed plugin) are kept, the state only when
+	// the source updated it for what it fetched
+	var partial content.PartialError
+	if fetchErr == nil || errors.As(fetchErr, &partial) {
+		app.DB.SaveSettings(space, settings)
+	}
+	log.Printf("Fetched %d contents from source %s", len(contents), space)
+	for _, data := range contents {
+		app.ContentQueue <- data
+	}
+	return len(contents), fetchErr
+}
+
+// StartRetention periodically removes conversations older than ChatRetention.
+func (app *App) StartRetention() {
+	if app.ChatRetention <= 0 {
+		return
+	}
+	app.pruneConversations()
+	ticker := time.NewTicker(time.Hour)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			app.processSource(source)
+			app.pruneConversations()
 		}
 	}
 }
 
-func (app *App) processSource(source content.Source) {
-	log.Printf("Fetching content from %s", source.Origin())
-	settings, err := app.DB.LoadSettings(source.Origin().String())
+func (app *App) pruneConversations() {
+	cutoff := time.Now().Add(-app.ChatRetention).UnixMilli()
+	expired, err := app.DB.ListBefore(content.CHAT, server.ConversationPrefix, cutoff)
 	if err != nil {
-		log.Printf("Failed to load settings: %v", err)
-		return
-	}
-	contents, err := source.FetchContent(settings)
-	if err != nil {
-		log.Printf("Failed to fetch contents: %v from source %s", err, source.Origin())
+		log.Printf("Failed to list expired conversations: %v", err)
 		return
 	}
-	log.Printf("Fetched %d contents from source %s", len(contents), source.Origin())
-	app.DB.SaveSettings(source.Origin().String(), settings)
-	for _, data := range contents {
-		data = data.Shrink()
-		app.ContentQueue <- data
-	}
-}
-
-func (app *App) ProcessQueue() {
-	for data := range app.ContentQueue {
-		err := app.DB.Add(data)
-		if err != nil {
-			log.Printf("Didn't add content to database: %v", err)
+	for _, data := range expired {
+		if err := app.Index.Delete(data); err != nil {
+			log.Printf("Failed to remove conversation %s from index: %v", data.ID, err)
 			continue
 		}
-
-		err = app.Index.Add(data)
-		if err != nil {
-			log.Printf("Failed to add content to index: %v", err)
-			err := app.DB.Failed(data)
-			if err != nil {
-				log.Printf("Failed to add update database: %v", err)
-			}
-		}
-		err = app.DB.Processed(data)
-		if err != nil {
-			log.Printf("Failed to add update database: %v", err)
+		if err := app.DB.Delete(data.Origin, data.ID); err != nil {
+			log.Printf("Failed to delete conversation %s: %v", data.ID, err)
 		}
-		for _, queue := range app.CompletionQueues {
-			queue <- data
-		}
-		log.Printf("Added content to %d queues", len(app.CompletionQueues))
 	}
-
+	if len(expired) > 0 {
+		log.Printf("Removed %d conversation turns older than %s", len(expired), app.ChatRetention)
+	}
 }
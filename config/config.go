@@ -6,6 +6,12 @@ import (
 	"path/filepath"
 )
 
+// Ports of the local servers pumago launches, llama chat backends must use others.
+const (
+	EmbeddingPort = 9991
+	WhisperPort   = 9992
+)
+
 func Dir() string {
 	return filepath.Join(os.Getenv("HOME"), ".config/puma")
 }
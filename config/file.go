@@ -0,0 +1,714 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the content of config.yaml, every key can be overridden with an
+// environment variable named after its path, e.g. PUMA_SERVER_PORT.
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Index     Index     `yaml:"index"`
+	Embedding Embedding `yaml:"embedding"`
+	LLM       LLM       `yaml:"llm"`
+	RAG       RAG       `yaml:"rag"`
+	Agent     Agent     `yaml:"agent"`
+	Chat      Chat      `yaml:"chat"`
+	Ingest    Ingest    `yaml:"ingest"`
+	Sources   Sources   `yaml:"sources"`
+}
+
+type Server struct {
+	// Host is the interface to listen on, only this machine can connect by default.
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// APIKey is a key with every scope, Keys adds named keys with restricted scopes.
+	// Without either a key is generated on the first run and kept in api_key next
+	// to the config file.
+	APIKey string   `yaml:"api_key"`
+	Keys   []APIKey `yaml:"keys"`
+	// WatchBuffer is how many contents a /watch stream buffers, WatchPolicy what
+	// happens when it is full: drop_newest, drop_oldest or disconnect.
+	WatchBuffer int    `yaml:"watch_buffer"`
+	WatchPolicy string `yaml:"watch_policy"`
+}
+
+type APIKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// Scopes are read, chat and admin, admin implies the others.
+	Scopes []string `yaml:"scopes"`
+}
+
+type Index struct {
+	ChunkSize     int     `yaml:"chunk_size"`
+	Threshold     float32 `yaml:"threshold"`
+	BookmarkBoost float32 `yaml:"bookmark_boost"`
+	QueryLimit    int     `yaml:"query_limit"`
+}
+
+// Embedding selects the provider used to embed documents and queries:
+// openai, openai-compatible, ollama or llama (a local llama-server).
+type Embedding struct {
+	Provider string `yaml:"provider"`
+	Model    string `yaml:"model"`
+	BaseURL  string `yaml:"base_url"`
+	APIKey   string `yaml:"api_key"`
+}
+
+// LLM is the default chat backend answering RAG and /raw requests, Backends are
+// more that a request selects with its model field.
+type LLM struct {
+	Provider string            `yaml:"provider"`
+	Model    string            `yaml:"model"`
+	BaseURL  string            `yaml:"base_url"`
+	APIKey   string            `yaml:"api_key"`
+	Headers  map[string]string `yaml:"headers"`
+	Models   map[string]string `yaml:"models"`
+	Port     int               `yaml:"port"`
+	// ContextWindow is the model's limit in tokens, 0 when unknown.
+	ContextWindow int       `yaml:"context_window"`
+	Backends      []Backend `yaml:"backends"`
+}
+
+// Backend is a chat model provider: openai, openai-compatible, ollama, vllm, llama
+// or anthropic. Model is used when a request doesn't name one and Models maps the
+// names requests use to the provider's. Without a BaseURL a llama backend launches
+// llama-server on Port with Model as its gguf file, chat.gguf by default.
+type Backend struct {
+	Name     string            `yaml:"name"`
+	Provider string            `yaml:"provider"`
+	Model    string            `yaml:"model"`
+	BaseURL  string            `yaml:"base_url"`
+	APIKey   string            `yaml:"api_key"`
+	Headers  map[string]string `yaml:"headers"`
+	Models   map[string]string `yaml:"models"`
+	Port     int               `yaml:"port"`
+	// ContextWindow is the model's limit in tokens, 0 when unknown.
+	ContextWindow int `yaml:"context_window"`
+}
+
+// DefaultBackendName names the backend configured directly under llm.
+const DefaultBackendName = "default"
+
+// AllBackends returns the default backend followed by the named ones.
+func (l LLM) AllBackends() []Backend {
+	backends := []Backend{{
+		Name:          DefaultBackendName,
+		Provider:      l.Provider,
+		Model:         l.Model,
+		BaseURL:       l.BaseURL,
+		APIKey:        l.APIKey,
+		Headers:       l.Headers,
+		Models:        l.Models,
+		Port:          l.Port,
+		ContextWindow: l.ContextWindow,
+	}}
+	return append(backends, l.Backends...)
+}
+
+// RAG tunes the documents given to the model along with a prompt.
+type RAG struct {
+	// ContextTokens is the most tokens of documents in a prompt, fewer when the
+	// conversation nearly fills the model's context window.
+	ContextTokens int `yaml:"context_tokens"`
+	// Candidates is how many chunks are retrieved to fill it.
+	Candidates int `yaml:"candidates"`
+	// Duplicate is the share of word triples above which a chunk repeats a better one.
+	Duplicate float32 `yaml:"duplicate"`
+	// Rewrite turns follow-up questions into standalone search queries with the
+	// chat model (llm), by prepending the previous turn (heuristic) or not at all (off).
+	Rewrite string `yaml:"rewrite"`
+	// RewriteModel is the model rewriting queries, the request's when empty.
+	RewriteModel string `yaml:"rewrite_model"`
+	// CacheSize conversation turns keep their rewritten queries and retrieved
+	// documents for CacheTTL after they were last used.
+	CacheSize int      `yaml:"cache_size"`
+	CacheTTL  Duration `yaml:"cache_ttl"`
+	// Template names the system prompt template of RAG answers: default, research,
+	// code, meeting or one of Templates, which add to or replace the builtin ones.
+	Template  string                    `yaml:"template"`
+	Templates map[string]PromptTemplate `yaml:"templates"`
+}
+
+// PromptTemplate is a Go text/template, given inline or as a File relative to
+// the config directory.
+type PromptTemplate struct {
+	Text string `yaml:"text"`
+	File string `yaml:"file"`
+}
+
+// Source returns the text of the template, reading its file if needed.
+func (t PromptTemplate) Source() (string, error) {
+	if t.File == "" {
+		return t.Text, nil
+	}
+	path := t.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(Dir(), path)
+	}
+	data, err := os.ReadFile(path)
+	return string(data), err
+}
+
+// Agent tunes the agent mode, where the chat model searches with tools before answering.
+type Agent struct {
+	// MaxSteps is how many rounds of tool calls the model gets before it must answer.
+	MaxSteps int `yaml:"max_steps"`
+	// FetchURLs lets the model fetch web pages live, FetchPrivate also lets it
+	// reach this machine and the local network.
+	FetchURLs    bool     `yaml:"fetch_urls"`
+	FetchPrivate bool     `yaml:"fetch_private"`
+	FetchTimeout Duration `yaml:"fetch_timeout"`
+}
+
+type Chat struct {
+	// Retention is how long stored conversations are kept, 0 keeps them forever.
+	Retention Duration `yaml:"retention"`
+}
+
+// Ingest tunes the pipeline storing and embedding fetched content.
+type Ingest struct {
+	Workers     int      `yaml:"workers"`
+	BatchSize   int      `yaml:"batch_size"`
+	BatchWait   Duration `yaml:"batch_wait"`
+	Retries     int      `yaml:"retries"`
+	CommitEvery Duration `yaml:"commit_every"`
+	// MaxAttempts failures turn content DEAD, before that it is retried every
+	// RetryDelay, doubling up to RetryMaxDelay.
+	MaxAttempts   int      `yaml:"max_attempts"`
+	RetryDelay    Duration `yaml:"retry_delay"`
+	RetryMaxDelay Duration `yaml:"retry_max_delay"`
+	RetryEvery    Duration `yaml:"retry_every"`
+	// DurableQueue keeps fetched content in a pending table until it is stored.
+	DurableQueue bool `yaml:"durable_queue"`
+}
+
+type Sources struct {
+	ScrapeEvery Duration   `yaml:"scrape_every"`
+	QueueSize   int        `yaml:"queue_size"`
+	Safari      Toggle     `yaml:"safari"`
+	Chrome      Toggle     `yaml:"chrome"`
+	Bookmarks   Toggle     `yaml:"bookmarks"`
+	Drive       Drive      `yaml:"drive"`
+	Mail        Paths      `yaml:"mail"`
+	ChatExports ChatExport `yaml:"chat_exports"`
+	Feeds       Feeds      `yaml:"feeds"`
+	Shell       Shell      `yaml:"shell"`
+	Git         Git        `yaml:"git"`
+	Audio       Audio      `yaml:"audio"`
+	Plugins     []Plugin   `yaml:"plugins"`
+	// Schedules overrides when a source runs, keyed by its name in GET /v1/sources,
+	// e.g. "chrome" or "plugin:notes". Sources without one run every ScrapeEvery.
+	Schedules map[string]Schedule `yaml:"schedules"`
+}
+
+// Schedule runs a source every Every or on a 5 field Cron expression.
+type Schedule struct {
+	Every  Duration `yaml:"every"`
+	Cron   string   `yaml:"cron"`
+	Jitter Duration `yaml:"jitter"`
+	Paused bool     `yaml:"paused"`
+}
+
+// ScheduleFor returns the schedule of the named source, "chrome-2" falls back
+// to the schedule of "chrome".
+func (s Sources) ScheduleFor(name string) Schedule {
+	schedule, ok := s.Schedules[name]
+	if !ok {
+		if base, suffix, found := cutLast(name, "-"); found && isDigits(suffix) {
+			schedule, ok = s.Schedules[base]
+		}
+	}
+	if !ok {
+		return Schedule{Every: s.ScrapeEvery}
+	}
+	if schedule.Every.Duration == 0 && schedule.Cron == "" {
+		schedule.Every = s.ScrapeEvery
+	}
+	return schedule
+}
+
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func isDigits(s string) bool {
+	_, err := strconv.Atoi(s)
+	return s != "" && err == nil
+}
+
+type Toggle struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type Drive struct {
+	Enabled  bool  `yaml:"enabled"`
+	PageSize int64 `yaml:"page_size"`
+}
+
+// Paths configures sources reading local files, empty Paths uses the default locations.
+type Paths struct {
+	Enabled bool     `yaml:"enabled"`
+	Paths   []string `yaml:"paths"`
+}
+
+type ChatExport struct {
+	Enabled     bool     `yaml:"enabled"`
+	Paths       []string `yaml:"paths"`
+	Gap         Duration `yaml:"gap"`
+	SlackDomain string   `yaml:"slack_domain"`
+}
+
+type Feeds struct {
+	Enabled bool     `yaml:"enabled"`
+	URLs    []string `yaml:"urls"`
+	OPML    string   `yaml:"opml"`
+}
+
+type Shell struct {
+	Enabled bool     `yaml:"enabled"`
+	Gap     Duration `yaml:"gap"`
+}
+
+type Git struct {
+	Enabled    bool     `yaml:"enabled"`
+	Repos      []string `yaml:"repos"`
+	MaxCommits int      `yaml:"max_commits"`
+	CommitURL  string   `yaml:"commit_url"`
+	FileURL    string   `yaml:"file_url"`
+}
+
+type Audio struct {
+	Enabled bool     `yaml:"enabled"`
+	Folder  string   `yaml:"folder"`
+	Window  Duration `yaml:"window"`
+}
+
+type Plugin struct {
+	Name    string            `yaml:"name"`
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`
+	Origin  string            `yaml:"origin"`
+	Timeout Duration          `yaml:"timeout"`
+}
+
+// Duration reads "5m" style durations.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", value.Line, value.Value)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// Default is the configuration used for keys missing from the file.
+func Default() Config {
+	return Config{
+		Server: Server{Host: "127.0.0.1", Port: 8888, WatchBuffer: 100, WatchPolicy: "drop_oldest"},
+		Index: Index{
+			ChunkSize:     1024,
+			Threshold:     0.2,
+			BookmarkBoost: 0.05,
+			QueryLimit:    10,
+		},
+		Embedding: Embedding{Provider: "openai", Model: "text-embedding-3-small"},
+		LLM:       LLM{Provider: "openai", Port: 9993},
+		Agent: Agent{
+			MaxSteps:     6,
+			FetchURLs:    true,
+			FetchTimeout: Duration{20 * time.Second},
+		},
+		RAG: RAG{
+			ContextTokens: 3000,
+			Candidates:    40,
+			Duplicate:     0.8,
+			Rewrite:       "llm",
+			CacheSize:     256,
+			CacheTTL:      Duration{30 * time.Minute},
+			Template:      "default",
+		},
+		Chat: Chat{Retention: Duration{90 * 24 * time.Hour}},
+		Ingest: Ingest{
+			Workers:     4,
+			BatchSize:   32,
+			BatchWait:   Duration{2 * time.Second},
+			Retries:     5,
+			CommitEvery: Duration{30 * time.Second},
+
+			MaxAttempts:   8,
+			RetryDelay:    Duration{time.Minute},
+			RetryMaxDelay: Duration{12 * time.Hour},
+			RetryEvery:    Duration{time.Minute},
+			DurableQueue:  true,
+		},
+		Sources: Sources{
+			ScrapeEvery: Duration{5 * time.Minute},
+			QueueSize:   1000,
+			Safari:      Toggle{Enabled: true},
+			Chrome:      Toggle{Enabled: true},
+			Bookmarks:   Toggle{Enabled: true},
+			Drive:       Drive{Enabled: true, PageSize: 10},
+			Mail:        Paths{Enabled: true},
+			ChatExports: ChatExport{Enabled: true, Gap: Duration{30 * time.Minute}, SlackDomain: "slack.com"},
+			Feeds:       Feeds{Enabled: true},
+			Shell:       Shell{Enabled: true, Gap: Duration{20 * time.Minute}},
+			Git:         Git{Enabled: true, MaxCommits: 500},
+			Audio:       Audio{Enabled: true, Window: Duration{time.Minute}},
+		},
+	}
+}
+
+func File() string {
+	return filepath.Join(Dir(), "config.yaml")
+}
+
+// Load reads the config file on top of the defaults, a missing file is not an
+// error, then applies environment overrides and validates the result.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cfg, err
+	}
+	if len(data) > 0 {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), "PUMA"); err != nil {
+		return cfg, err
+	}
+	if cfg.Embedding.APIKey == "" && cfg.Embedding.Provider == "openai" {
+		cfg.Embedding.APIKey = os.Getenv("OPENAI_API_KEY")
+	}
+	cfg.LLM.APIKey = providerKey(cfg.LLM.Provider, cfg.LLM.APIKey)
+	for i := range cfg.LLM.Backends {
+		cfg.LLM.Backends[i].APIKey = providerKey(cfg.LLM.Backends[i].Provider, cfg.LLM.Backends[i].APIKey)
+	}
+	if cfg.Server.APIKey == "" && len(cfg.Server.Keys) == 0 {
+		key, err := generatedKey(filepath.Join(filepath.Dir(path), "api_key"))
+		if err != nil {
+			return cfg, fmt.Errorf("server.api_key: %w", err)
+		}
+		cfg.Server.APIKey = key
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// providerKey falls back to the provider's usual environment variable.
+func providerKey(provider string, key string) string {
+	if key != "" {
+		return key
+	}
+	switch provider {
+	case "openai":
+		return os.Getenv("OPENAI_API_KEY")
+	case "anthropic":
+		return os.Getenv("ANTHROPIC_API_KEY")
+	}
+	return ""
+}
+
+// redacted replaces the secrets printed by --print-config.
+const redacted = "***"
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactHeaders hides every header value, they often carry credentials.
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		out[name] = redact(value)
+	}
+	return out
+}
+
+// Redacted returns a copy of the config without its keys, safe to print.
+func (c Config) Redacted() Config {
+	c.Server.APIKey = redact(c.Server.APIKey)
+	keys := make([]APIKey, len(c.Server.Keys))
+	for i, key := range c.Server.Keys {
+		key.Key = redact(key.Key)
+		keys[i] = key
+	}
+	c.Server.Keys = keys
+	c.Embedding.APIKey = redact(c.Embedding.APIKey)
+	c.LLM.APIKey = redact(c.LLM.APIKey)
+	c.LLM.Headers = redactHeaders(c.LLM.Headers)
+	backends := make([]Backend, len(c.LLM.Backends))
+	for i, backend := range c.LLM.Backends {
+		backend.APIKey = redact(backend.APIKey)
+		backend.Headers = redactHeaders(backend.Headers)
+		backends[i] = backend
+	}
+	c.LLM.Backends = backends
+	return c
+}
+
+// applyEnv overrides scalar and string list fields from PUMA_<PATH> variables.
+func applyEnv(value reflect.Value, prefix string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + "_" + strings.ToUpper(name)
+		target := value.Field(i)
+		if target.Type() == reflect.TypeOf(Duration{}) {
+			if env, ok := os.LookupEnv(key); ok {
+				parsed, err := time.ParseDuration(env)
+				if err != nil {
+					return fmt.Errorf("%s: invalid duration %q", key, env)
+				}
+				target.Set(reflect.ValueOf(Duration{parsed}))
+			}
+			continue
+		}
+		if target.Kind() == reflect.Struct {
+			if err := applyEnv(target, key); err != nil {
+				return err
+			}
+			continue
+		}
+		env, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		var err error
+		switch target.Kind() {
+		case reflect.String:
+			target.SetString(env)
+		case reflect.Bool:
+			var parsed bool
+			parsed, err = strconv.ParseBool(env)
+			target.SetBool(parsed)
+		case reflect.Int, reflect.Int64:
+			var parsed int64
+			parsed, err = strconv.ParseInt(env, 10, 64)
+			target.SetInt(parsed)
+		case reflect.Float32, reflect.Float64:
+			var parsed float64
+			parsed, err = strconv.ParseFloat(env, 64)
+			target.SetFloat(parsed)
+		case reflect.Slice:
+			if target.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s: can't be set from the environment", key)
+			}
+			target.Set(reflect.ValueOf(strings.Split(env, ",")))
+		default:
+			return fmt.Errorf("%s: can't be set from the environment", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %q: %v", key, env, err)
+		}
+	}
+	return nil
+}
+
+// knownKey is the api_key earlier versions defaulted to, anyone knows it.
+const knownKey = "123456"
+
+// generatedKey reads the API key generated on the first run without one, or
+// generates it. Only the user can read the file.
+func generatedKey(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil && len(bytes.TrimSpace(data)) > 0 {
+		return string(bytes.TrimSpace(data)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(random)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to save the generated key: %w", err)
+	}
+	log.Printf("Generated an API key in %s, clients send it as a Bearer token", path)
+	return key, nil
+}
+
+// fieldError names the offending key in a validation error.
+type fieldError struct {
+	key     string
+	message string
+}
+
+func (e fieldError) Error() string {
+	return e.key + ": " + e.message
+}
+
+// Validate checks the values that would otherwise fail later at runtime.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key string, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fieldError{key: key, message: fmt.Sprintf(format, args...)})
+		}
+	}
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	check(c.Server.APIKey != "" || len(c.Server.Keys) > 0, "server.api_key", "is required unless server.keys is set")
+	check(c.Server.APIKey != knownKey, "server.api_key", "%q is the old default key anyone knows, remove it to get a generated one", knownKey)
+	keyNames := make(map[string]bool)
+	for i, key := range c.Server.Keys {
+		prefix := fmt.Sprintf("server.keys[%d]", i)
+		check(key.Name != "", prefix+".name", "is required")
+		check(!keyNames[key.Name], prefix+".name", "duplicate key %q", key.Name)
+		keyNames[key.Name] = true
+		check(len(key.Key) >= 16, prefix+".key", "must be at least 16 characters")
+		check(len(key.Scopes) > 0, prefix+".scopes", "is required")
+		for j, scope := range key.Scopes {
+			check(scope == "read" || scope == "chat" || scope == "admin", fmt.Sprintf("%s.scopes[%d]", prefix, j),
+				"must be read, chat or admin, got %q", scope)
+		}
+	}
+	check(c.Server.WatchBuffer > 0, "server.watch_buffer", "must be positive, got %d", c.Server.WatchBuffer)
+	policies := map[string]bool{"drop_newest": true, "drop_oldest": true, "disconnect": true}
+	check(policies[c.Server.WatchPolicy], "server.watch_policy", "must be one of drop_newest, drop_oldest or disconnect, got %q", c.Server.WatchPolicy)
+	check(c.Index.ChunkSize > 0, "index.chunk_size", "must be positive, got %d", c.Index.ChunkSize)
+	check(c.Index.Threshold >= -1 && c.Index.Threshold <= 1, "index.threshold", "must be between -1 and 1, got %g", c.Index.Threshold)
+	check(c.Index.QueryLimit > 0, "index.query_limit", "must be positive, got %d", c.Index.QueryLimit)
+
+	providers := map[string]bool{"openai": true, "openai-compatible": true, "ollama": true, "llama": true}
+	check(providers[c.Embedding.Provider], "embedding.provider", "must be one of openai, openai-compatible, ollama or llama, got %q", c.Embedding.Provider)
+	check(c.Embedding.Model != "" || c.Embedding.Provider == "llama", "embedding.model", "is required")
+	check(c.Embedding.BaseURL != "" || c.Embedding.Provider != "openai-compatible", "embedding.base_url", "is required for openai-compatible")
+	chatProviders := map[string]bool{"openai": true, "openai-compatible": true, "ollama": true, "vllm": true, "llama": true, "anthropic": true}
+	backendNames := make(map[string]bool)
+	llamaPorts := make(map[int]bool)
+	for i, backend := range c.LLM.AllBackends() {
+		prefix := "llm"
+		if i > 0 {
+			prefix = fmt.Sprintf("llm.backends[%d]", i-1)
+			check(backend.Name != "", prefix+".name", "is required")
+			check(!strings.Contains(backend.Name, "/"), prefix+".name", "must not contain '/', got %q", backend.Name)
+		}
+		check(!backendNames[backend.Name], prefix+".name", "duplicate backend %q", backend.Name)
+		backendNames[backend.Name] = true
+		check(chatProviders[backend.Provider], prefix+".provider",
+			"must be one of openai, openai-compatible, ollama, vllm, llama or anthropic, got %q", backend.Provider)
+		check(backend.BaseURL != "" || backend.Provider != "openai-compatible", prefix+".base_url", "is required for openai-compatible")
+		check(backend.ContextWindow >= 0, prefix+".context_window", "must not be negative, got %d", backend.ContextWindow)
+		if backend.Provider == "llama" && backend.BaseURL == "" {
+			check(backend.Port > 0 && backend.Port < 65536, prefix+".port", "must be between 1 and 65535, got %d", backend.Port)
+			check(backend.Port != EmbeddingPort, prefix+".port", "%d is used by the embedding server", EmbeddingPort)
+			check(backend.Port != WhisperPort, prefix+".port", "%d is used by whisper-server", WhisperPort)
+			check(!llamaPorts[backend.Port], prefix+".port", "%d is used by another llama backend", backend.Port)
+			llamaPorts[backend.Port] = true
+		}
+	}
+	check(c.RAG.ContextTokens > 0, "rag.context_tokens", "must be positive, got %d", c.RAG.ContextTokens)
+	check(c.RAG.Candidates > 0, "rag.candidates", "must be positive, got %d", c.RAG.Candidates)
+	check(c.RAG.Duplicate > 0 && c.RAG.Duplicate <= 1, "rag.duplicate", "must be between 0 and 1, got %g", c.RAG.Duplicate)
+	check(c.RAG.Rewrite == "llm" || c.RAG.Rewrite == "heuristic" || c.RAG.Rewrite == "off", "rag.rewrite",
+		"must be llm, heuristic or off, got %q", c.RAG.Rewrite)
+	check(c.RAG.CacheSize >= 0, "rag.cache_size", "must not be negative, got %d", c.RAG.CacheSize)
+	check(c.RAG.CacheTTL.Duration >= 0, "rag.cache_ttl", "must not be negative")
+	check(c.RAG.Template != "", "rag.template", "is required")
+	templates := make([]string, 0, len(c.RAG.Templates))
+	for name := range c.RAG.Templates {
+		templates = append(templates, name)
+	}
+	sort.Strings(templates)
+	for _, name := range templates {
+		key := "rag.templates." + name
+		check(name != "" && strings.Trim(strings.ToLower(name), "abcdefghijklmnopqrstuvwxyz0123456789_-") == "", key,
+			"names may only use letters, digits, '_' and '-'")
+		template := c.RAG.Templates[name]
+		check((template.Text == "") != (template.File == ""), key, "set either text or file")
+	}
+	check(c.Agent.MaxSteps > 0, "agent.max_steps", "must be positive, got %d", c.Agent.MaxSteps)
+	check(c.Agent.FetchTimeout.Duration > 0, "agent.fetch_timeout", "must be positive")
+	check(c.Chat.Retention.Duration >= 0, "chat.retention", "must not be negative")
+
+	check(c.Ingest.Workers > 0, "ingest.workers", "must be positive, got %d", c.Ingest.Workers)
+	check(c.Ingest.BatchSize > 0, "ingest.batch_size", "must be positive, got %d", c.Ingest.BatchSize)
+	check(c.Ingest.BatchWait.Duration > 0, "ingest.batch_wait", "must be positive")
+	check(c.Ingest.Retries >= 0, "ingest.retries", "must not be negative, got %d", c.Ingest.Retries)
+	check(c.Ingest.CommitEvery.Duration > 0, "ingest.commit_every", "must be positive")
+	check(c.Ingest.MaxAttempts > 0, "ingest.max_attempts", "must be positive, got %d", c.Ingest.MaxAttempts)
+	check(c.Ingest.RetryDelay.Duration > 0, "ingest.retry_delay", "must be positive")
+	check(c.Ingest.RetryMaxDelay.Duration >= c.Ingest.RetryDelay.Duration, "ingest.retry_max_delay", "must not be less than retry_delay")
+	check(c.Ingest.RetryEvery.Duration > 0, "ingest.retry_every", "must be positive")
+
+	check(c.Sources.ScrapeEvery.Duration > 0, "sources.scrape_every", "must be positive")
+	check(c.Sources.QueueSize > 0, "sources.queue_size", "must be positive, got %d", c.Sources.QueueSize)
+	check(c.Sources.Drive.PageSize > 0, "sources.drive.page_size", "must be positive, got %d", c.Sources.Drive.PageSize)
+	check(c.Sources.ChatExports.Gap.Duration > 0, "sources.chat_exports.gap", "must be positive")
+	check(c.Sources.Shell.Gap.Duration > 0, "sources.shell.gap", "must be positive")
+	check(c.Sources.Git.MaxCommits > 0, "sources.git.max_commits", "must be positive, got %d", c.Sources.Git.MaxCommits)
+	check(c.Sources.Audio.Window.Duration > 0, "sources.audio.window", "must be positive")
+	scheduled := make([]string, 0, len(c.Sources.Schedules))
+	for name := range c.Sources.Schedules {
+		scheduled = append(scheduled, name)
+	}
+	sort.Strings(scheduled)
+	for _, name := range scheduled {
+		schedule := c.Sources.Schedules[name]
+		key := "sources.schedules." + name
+		check(schedule.Every.Duration >= 0, key+".every", "must not be negative")
+		check(schedule.Jitter.Duration >= 0, key+".jitter", "must not be negative")
+		check(schedule.Every.Duration == 0 || schedule.Cron == "", key, "set either every or cron")
+		if schedule.Cron != "" {
+			_, err := cron.ParseStandard(schedule.Cron)
+			check(err == nil, key+".cron", "%v", err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, plugin := range c.Sources.Plugins {
+		key := fmt.Sprintf("sources.plugins[%d]", i)
+		check(plugin.Name != "", key+".name", "is required")
+		check(plugin.Command != "", key+".command", "is required")
+		check(!names[plugin.Name], key+".name", "duplicate plugin %q", plugin.Name)
+		names[plugin.Name] = true
+	}
+	return errors.Join(errs...)
+}
@@ -14,6 +14,8 @@ const (
 	NEW Status = iota
 	PROCESSED
 	FAILED
+	// DEAD is content that failed RetryPolicy.MaxAttempts times, only a manual retry picks it up.
+	DEAD
 )
 const (
 	UNKNOWN Origin = iota
@@ -22,17 +24,24 @@ const (
 	GOOGLE_DRIVE
 	AUDIO
 	CHAT
+	EMAIL
+	FEED
+	BOOKMARK
+	SHELL
+	GIT
 )
 
 func (s Status) String() string {
-	return [...]string{"NEW", "PROCESSED", "FAILED"}[s]
+	return [...]string{"NEW", "PROCESSED", "FAILED", "DEAD"}[s]
 }
 func (s Origin) String() string {
-	return [...]string{"UNKNOWN", "CHROME", "SAFARI", "GOOGLE_DRIVE", "AUDIO", "CHAT"}[s]
+	return [...]string{"UNKNOWN", "CHROME", "SAFARI", "GOOGLE_DRIVE", "AUDIO", "CHAT", "EMAIL", "FEED", "BOOKMARK", "SHELL", "GIT"}[s]
 }
 func ParseOrigin(input string) (Origin, error) {
 	input = strings.ToLower(input)
 	switch input {
+	case "unknown":
+		return UNKNOWN, nil
 	case "chrome":
 		return CHROME, nil
 	case "safari":
@@ -43,11 +52,22 @@ func ParseOrigin(input string) (Origin, error) {
 		return CHAT, nil
 	case "google_drive":
 		return GOOGLE_DRIVE, nil
+	case "email":
+		return EMAIL, nil
+	case "feed":
+		return FEED, nil
+	case "bookmark":
+		return BOOKMARK, nil
+	case "shell":
+		return SHELL, nil
+	case "git":
+		return GIT, nil
 	default:
 		return UNKNOWN, fmt.Errorf("invalid origin: %s", input)
 	}
 }
 func ParseStatus(input string) (Status, error) {
+	input = strings.ToLower(input)
 	switch input {
 	case "new":
 		return NEW, nil
@@ -55,6 +75,8 @@ func ParseStatus(input string) (Status, error) {
 		return PROCESSED, nil
 	case "failed":
 		return FAILED, nil
+	case "dead":
+		return DEAD, nil
 	default:
 		return -1, fmt.Errorf("invalid status: %s", input)
 	}
@@ -65,6 +87,34 @@ type Source interface {
 	Origin() Origin
 }
 
+// StateNamer is implemented by sources that must not share their persisted state
+// with other sources of the same origin.
+type StateNamer interface {
+	StateName() string
+}
+
+// PartialError is returned by sources that fetched some of their inputs, e.g.
+// all feeds but a broken one. The state they updated for the others is saved.
+type PartialError struct {
+	Err error
+}
+
+func (e PartialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PartialError) Unwrap() error {
+	return e.Err
+}
+
+// StateSpace is the key a source's state is persisted under.
+func StateSpace(source Source) string {
+	if named, ok := source.(StateNamer); ok {
+		return named.StateName()
+	}
+	return source.Origin().String()
+}
+
 // Content represents a single entry in the file history.
 type Content struct {
 	Origin             Origin `json:"origin"`
@@ -75,6 +125,11 @@ type Content struct {
 	Fragment           int    `json:"fragment"`
 	Content            string `json:"content"`
 	Status             Status `json:"status"`
+	// Metadata holds origin specific attributes (e.g. From/To for EMAIL).
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Deleted tells the pipeline to remove the stored content with this ID, e.g.
+	// a file deleted since the last fetch. Only Origin and ID matter then.
+	Deleted bool `json:"deleted,omitempty"`
 }
 
 func (c Content) Shrink() Content {
@@ -105,7 +160,7 @@ func ConvertURLToFilename(url string) string {
 type ContentManger interface {
 	Add(content Content) error
 	Processed(content Content) error
-	Failed(content Content) error
+	Failed(content Content, cause error, policy RetryPolicy) error
 	Get(origin Origin, id string) (Content, error)
 	List(origin Origin, status Status) ([]Content, error)
 }
@@ -2,10 +2,13 @@ package content
 
 import (
 	"database/sql"
+	"encoding/json"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver for database/sql
 	"log"
 	"path/filepath"
 	"pumago/config"
+	"strings"
+	"time"
 )
 
 type DB struct {
@@ -28,6 +31,11 @@ func DefaultDB() DB {
 	if err != nil {
 		log.Fatalf("Failed to create state table: %v", err)
 	}
+
+	err = out.createPendingTable()
+	if err != nil {
+		log.Fatalf("Failed to create pending table: %v", err)
+	}
 	return out
 }
 
@@ -42,41 +50,105 @@ func (db *DB) createContentTable() error {
         origin INTEGER,
         content TEXT,
         status INTEGER,
+        metadata TEXT,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        last_error TEXT,
+        retry_at INTEGER,
         PRIMARY KEY (id, origin)
     );`
 	_, err := db.Exec(query)
-	return err
+	if err != nil {
+		return err
+	}
+	columns := [][2]string{
+		{"metadata", "TEXT"},
+		{"attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"last_error", "TEXT"},
+		{"retry_at", "INTEGER"},
+	}
+	for _, column := range columns {
+		if err := db.addColumn("file_entries", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (db *DB) insertContent(entry Content) error {
-	query := `
-    INSERT INTO file_entries (id, url, title, last_modified_millis, fragment, origin, content, status)
-    VALUES (?, ?, ?, ?, ?, ? , ?, ?);`
-	_, err := db.Exec(query, entry.ID, entry.URL, entry.Title, entry.LastModifiedMillis, entry.Fragment, entry.Origin, entry.Content, entry.Status)
+// addColumn adds a column to a table created by an older version, ignoring the
+// error when the column already exists.
+func (db *DB) addColumn(table string, column string, definition string) error {
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition + ";")
+	if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+		return nil
+	}
 	return err
 }
 
-func (db *DB) getContentByID(origin Origin, id string) (Content, error) {
-	query := `SELECT id, url, title, last_modified_millis, fragment, origin, content, status FROM file_entries WHERE id = ? and origin = ?;`
-	row := db.QueryRow(query, id, origin)
+const contentColumns = `id, url, title, last_modified_millis, fragment, origin, content, status, metadata`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
 
+// scanContent reads contentColumns, extra receives the columns selected after them.
+func scanContent(row scanner, extra ...any) (Content, error) {
 	var entry Content
-	err := row.Scan(&entry.ID, &entry.URL, &entry.Title, &entry.LastModifiedMillis, &entry.Fragment, &entry.Origin, &entry.Content, &entry.Status)
+	var metadata sql.NullString
+	dest := []any{&entry.ID, &entry.URL, &entry.Title, &entry.LastModifiedMillis, &entry.Fragment, &entry.Origin, &entry.Content, &entry.Status, &metadata}
+	err := row.Scan(append(dest, extra...)...)
 	if err != nil {
 		return entry, err
 	}
-	return entry, nil
+	if metadata.Valid && metadata.String != "" {
+		err = json.Unmarshal([]byte(metadata.String), &entry.Metadata)
+	}
+	return entry, err
 }
 
-func (db *DB) updateContentStatus(entry Content) error {
+func encodeMetadata(metadata map[string]string) (sql.NullString, error) {
+	if len(metadata) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func (db *DB) insertContent(entry Content) error {
+	metadata, err := encodeMetadata(entry.Metadata)
+	if err != nil {
+		return err
+	}
+	query := `
+    INSERT INTO file_entries (` + contentColumns + `)
+    VALUES (?, ?, ?, ?, ?, ? , ?, ?, ?);`
+	_, err = db.Exec(query, entry.ID, entry.URL, entry.Title, entry.LastModifiedMillis, entry.Fragment, entry.Origin, entry.Content, entry.Status, metadata)
+	return err
+}
+
+// replaceContent overwrites a stored content with a new version to index.
+func (db *DB) replaceContent(entry Content) error {
+	metadata, err := encodeMetadata(entry.Metadata)
+	if err != nil {
+		return err
+	}
 	query := `
     UPDATE file_entries
-    SET status = ?
+    SET url = ?, title = ?, last_modified_millis = ?, fragment = ?, content = ?, status = ?, metadata = ?,
+        attempts = 0, last_error = NULL, retry_at = NULL
     WHERE id = ? AND origin = ?;`
-	_, err := db.Exec(query, entry.Status, entry.ID, entry.Origin)
+	_, err = db.Exec(query, entry.URL, entry.Title, entry.LastModifiedMillis, entry.Fragment, entry.Content, NEW, metadata, entry.ID, entry.Origin)
 	return err
 }
 
+func (db *DB) getContentByID(origin Origin, id string) (Content, error) {
+	query := `SELECT ` + contentColumns + ` FROM file_entries WHERE id = ? and origin = ?;`
+	row := db.QueryRow(query, id, origin)
+	return scanContent(row)
+}
+
 func (db *DB) deleteContent(origin Origin, id string) error {
 	query := `DELETE FROM file_entries WHERE id = ? and origin = ? ;`
 	_, err := db.Exec(query, id, origin)
@@ -88,50 +160,157 @@ func (db *DB) Add(content Content) error {
 	return db.insertContent(content)
 }
 
-func (db *DB) Processed(content Content) error {
-	content.Status = PROCESSED
-	return db.updateContentStatus(content)
+// Replace stores a changed version of a content, it has to be indexed again.
+func (db *DB) Replace(content Content) error {
+	return db.replaceContent(content)
 }
 
-func (db *DB) Failed(content Content) error {
-	content.Status = FAILED
-	return db.updateContentStatus(content)
-}
+// markProcessed also forgets earlier failures, a later one starts over from the
+// first attempt instead of going straight to DEAD.
+const markProcessed = `UPDATE file_entries SET status = ?, attempts = 0, last_error = NULL, retry_at = NULL WHERE id = ? AND origin = ?;`
 
-func (db *DB) Get(origin Origin, id string) (Content, error) {
-	return db.getContentByID(origin, id)
-}
-func (db *DB) UpdateAll(status Status) error {
-	query := `UPDATE file_entries SET status = ?;`
-	_, err := db.Exec(query, status)
+func (db *DB) Processed(content Content) error {
+	_, err := db.Exec(markProcessed, PROCESSED, content.ID, content.Origin)
 	return err
 }
 
-func (db *DB) All(status Status) ([]Content, error) {
-	query := `SELECT id, url, title, last_modified_millis, fragment, origin, content, status FROM file_entries WHERE status = ?;`
+// Failed records a failed attempt, the content is retried after policy.Delay or
+// becomes DEAD once it failed policy.MaxAttempts times.
+func (db *DB) Failed(content Content, cause error, policy RetryPolicy) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var attempts int
+	err = tx.QueryRow(`SELECT attempts FROM file_entries WHERE id = ? AND origin = ?;`, content.ID, content.Origin).Scan(&attempts)
+	if err != nil {
+		return err
+	}
+	attempts++
+	status := FAILED
+	retryAt := sql.NullInt64{Int64: time.Now().Add(policy.Delay(attempts)).UnixMilli(), Valid: true}
+	if attempts >= policy.MaxAttempts {
+		status = DEAD
+		retryAt = sql.NullInt64{}
+	}
+	query := `
+    UPDATE file_entries
+    SET status = ?, attempts = ?, last_error = ?, retry_at = ?
+    WHERE id = ? AND origin = ?;`
+	_, err = tx.Exec(query, status, attempts, cause.Error(), retryAt, content.ID, content.Origin)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Failures lists FAILED or DEAD content, most recent failures to be retried last.
+func (db *DB) Failures(status Status) ([]Failure, error) {
+	query := `SELECT ` + contentColumns + `, attempts, last_error, retry_at FROM file_entries WHERE status = ? ORDER BY retry_at;`
 	rows, err := db.Query(query, status)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var contents []Content
+	failures := make([]Failure, 0)
 	for rows.Next() {
-		var content Content
-		if err := rows.Scan(&content.ID, &content.URL, &content.Title, &content.LastModifiedMillis, &content.Fragment, &content.Origin, &content.Content, &content.Status); err != nil {
+		var failure Failure
+		var lastError sql.NullString
+		var retryAt sql.NullInt64
+		entry, err := scanContent(rows, &failure.Attempts, &lastError, &retryAt)
+		if err != nil {
 			return nil, err
 		}
-		contents = append(contents, content)
+		failure.Content = entry
+		failure.LastError = lastError.String
+		failure.RetryAtMillis = retryAt.Int64
+		failures = append(failures, failure)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return failures, rows.Err()
+}
+
+// DueForRetry returns up to limit FAILED contents whose retry time has passed.
+func (db *DB) DueForRetry(limit int) ([]Content, error) {
+	query := `SELECT ` + contentColumns + ` FROM file_entries WHERE status = ? AND retry_at <= ? ORDER BY retry_at LIMIT ?;`
+	return db.queryContents(query, FAILED, time.Now().UnixMilli(), limit)
+}
+
+// Requeue sets content back to NEW before it is indexed again, resetAttempts
+// gives manually retried content a fresh set of attempts.
+func (db *DB) Requeue(content Content, resetAttempts bool) error {
+	query := `UPDATE file_entries SET status = ?, retry_at = NULL WHERE id = ? AND origin = ?;`
+	if resetAttempts {
+		query = `UPDATE file_entries SET status = ?, retry_at = NULL, attempts = 0 WHERE id = ? AND origin = ?;`
 	}
-	return contents, nil
+	_, err := db.Exec(query, NEW, content.ID, content.Origin)
+	return err
+}
+
+// ProcessedAll marks contents as processed in a single transaction.
+func (db *DB) ProcessedAll(contents []Content) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, entry := range contents {
+		_, err := tx.Exec(markProcessed, PROCESSED, entry.ID, entry.Origin)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) Get(origin Origin, id string) (Content, error) {
+	return db.getContentByID(origin, id)
+}
+func (db *DB) UpdateAll(status Status) error {
+	query := `UPDATE file_entries SET status = ?;`
+	_, err := db.Exec(query, status)
+	return err
+}
+
+func (db *DB) All(status Status) ([]Content, error) {
+	query := `SELECT ` + contentColumns + ` FROM file_entries WHERE status = ?;`
+	return db.queryContents(query, status)
 }
 
 func (db *DB) List(origin Origin, status Status) ([]Content, error) {
-	query := `SELECT id, url, title, last_modified_millis, fragment, origin, content, status FROM file_entries WHERE status = ? and origin = ?;`
-	rows, err := db.Query(query, status, origin)
+	query := `SELECT ` + contentColumns + ` FROM file_entries WHERE status = ? and origin = ?;`
+	return db.queryContents(query, status, origin)
+}
+
+// ListBefore returns the content of an origin whose ID starts with idPrefix and
+// that was last modified before the given time.
+func (db *DB) ListBefore(origin Origin, idPrefix string, beforeMillis int64) ([]Content, error) {
+	query := `SELECT ` + contentColumns + ` FROM file_entries WHERE origin = ? and id LIKE ? and last_modified_millis < ?;`
+	return db.queryContents(query, origin, idPrefix+"%", beforeMillis)
+}
+
+// Recent returns the limit most recently modified contents of origins, of every
+// origin when none is given.
+func (db *DB) Recent(limit int, origins ...Origin) ([]Content, error) {
+	query := `SELECT ` + contentColumns + ` FROM file_entries`
+	args := make([]any, 0, len(origins)+1)
+	if len(origins) > 0 {
+		query += ` WHERE origin IN (?` + strings.Repeat(", ?", len(origins)-1) + `)`
+		for _, origin := range origins {
+			args = append(args, origin)
+		}
+	}
+	query += ` ORDER BY last_modified_millis DESC LIMIT ?;`
+	return db.queryContents(query, append(args, limit)...)
+}
+
+func (db *DB) Delete(origin Origin, id string) error {
+	return db.deleteContent(origin, id)
+}
+
+func (db *DB) queryContents(query string, args ...any) ([]Content, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -139,8 +318,8 @@ func (db *DB) List(origin Origin, status Status) ([]Content, error) {
 
 	var contents []Content
 	for rows.Next() {
-		var content Content
-		if err := rows.Scan(&content.ID, &content.URL, &content.Title, &content.LastModifiedMillis, &content.Fragment, &content.Origin, &content.Content, &content.Status); err != nil {
+		content, err := scanContent(rows)
+		if err != nil {
 			return nil, err
 		}
 		contents = append(contents, content)
@@ -188,9 +367,27 @@ func (db *DB) creatStateTable() error {
 	_, err := db.Exec(query)
 	return err
 }
+
+// SaveSettings replaces the state of a space, keys a source deleted are gone.
 func (db *DB) SaveSettings(space string, all map[string]string) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to save state of %s: %v", space, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM states WHERE space = ?;`, space); err != nil {
+		log.Printf("Failed to save state of %s: %v", space, err)
+		return
+	}
 	for key, value := range all {
-		db.SetState(space, key, value) //todo find a way to clobber old values
+		if _, err := tx.Exec(`INSERT INTO states (space, key, value) VALUES (?, ?, ?);`, space, key, value); err != nil {
+			log.Printf("Failed to save state of %s: %v", space, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to save state of %s: %v", space, err)
 	}
 }
 func (db *DB) LoadSettings(space string) (map[string]string, error) {
@@ -0,0 +1,66 @@
+package content
+
+import "encoding/json"
+
+// The pending table holds content fetched from a source but not yet inserted in
+// file_entries, so it survives a crash between the source saving its state and
+// the pipeline storing the content.
+
+func (db *DB) createPendingTable() error {
+	query := `
+    CREATE TABLE IF NOT EXISTS pending (
+        id TEXT,
+        origin INTEGER,
+        data TEXT,
+        PRIMARY KEY (id, origin)
+    );`
+	_, err := db.Exec(query)
+	return err
+}
+
+// AddPending records contents in a single transaction.
+func (db *DB) AddPending(contents []Content) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, entry := range contents {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO pending (id, origin, data) VALUES (?, ?, ?);`, entry.ID, entry.Origin, string(data))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) RemovePending(entry Content) error {
+	_, err := db.Exec(`DELETE FROM pending WHERE id = ? AND origin = ?;`, entry.ID, entry.Origin)
+	return err
+}
+
+func (db *DB) Pending() ([]Content, error) {
+	rows, err := db.Query(`SELECT data FROM pending;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contents := make([]Content, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var entry Content
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, err
+		}
+		contents = append(contents, entry)
+	}
+	return contents, rows.Err()
+}
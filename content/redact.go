@@ -0,0 +1,27 @@
+package content
+
+import "regexp"
+
+type redaction struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// redactions match common credentials, the replacement keeps the key name so
+// the surrounding command stays readable.
+var redactions = []redaction{
+	{regexp.MustCompile(`(?i)\b([A-Z0-9_]*(?:SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|ACCESS_KEY)[A-Z0-9_]*)=("[^"]*"|'[^']*'|\S+)`), "$1=[REDACTED]"},
+	{regexp.MustCompile(`(?i)(--?(?:password|passwd|token|secret|api-key|apikey|access-key)[= ])("[^"]*"|'[^']*'|\S+)`), "$1[REDACTED]"},
+	{regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic|token)\s+)[A-Za-z0-9._~+/=-]+`), "$1[REDACTED]"},
+	{regexp.MustCompile(`(?i)\b(https?://[^:/\s]+:)[^@/\s]+@`), "$1[REDACTED]@"},
+	{regexp.MustCompile(`\b(?:sk-[A-Za-z0-9_-]{20,}|gh[pousr]_[A-Za-z0-9]{30,}|xox[abpr]-[A-Za-z0-9-]{10,}|AKIA[0-9A-Z]{16}|AIza[0-9A-Za-z_-]{35})\b`), "[REDACTED]"},
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), "[REDACTED PRIVATE KEY]"},
+}
+
+// Redact masks secrets such as API keys, tokens and passwords in text.
+func Redact(text string) string {
+	for _, r := range redactions {
+		text = r.pattern.ReplaceAllString(text, r.replacement)
+	}
+	return text
+}
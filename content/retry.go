@@ -0,0 +1,28 @@
+package content
+
+import "time"
+
+// RetryPolicy decides when FAILED content is retried and when it is given up on.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Delay is the wait before the next attempt, doubling from BaseDelay up to MaxDelay.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// Failure is FAILED or DEAD content along with why and when it is retried.
+type Failure struct {
+	Content
+	Attempts  int
+	LastError string
+	// RetryAtMillis is 0 for DEAD content.
+	RetryAtMillis int64
+}
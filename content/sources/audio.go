@@ -0,0 +1,235 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pumago/config"
+	"pumago/content"
+	"pumago/process"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var mediaExtensions = map[string]bool{
+	".wav": true, ".mp3": true, ".m4a": true, ".ogg": true, ".flac": true, ".opus": true,
+	".mp4": true, ".mov": true, ".mkv": true, ".webm": true,
+}
+
+// Audio transcribes the recordings of a folder with a local whisper.cpp server,
+// each window of segments becomes a Fragment pointing at its time in the recording.
+type Audio struct {
+	folder string
+	port   int
+	client *http.Client
+	// Window is the length of recording stored per Fragment.
+	Window time.Duration
+}
+
+func AudioFolder(folder string) *Audio {
+	return &Audio{
+		folder: folder,
+		port:   config.WhisperPort,
+		client: &http.Client{Timeout: 30 * time.Minute},
+		Window: time.Minute,
+	}
+}
+
+// DefaultAudio watches the recordings folder of the config dir when whisper-server
+// is installed, returns nil otherwise.
+func DefaultAudio() *Audio {
+	folder := filepath.Join(config.Dir(), "recordings")
+	if _, err := os.Stat(folder); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(config.BinDir(), "whisper-server")); err != nil {
+		log.Printf("Found %s but no whisper-server, skipping transcription", folder)
+		return nil
+	}
+	return AudioFolder(folder)
+}
+
+// Launch forks whisper-server, --convert lets it decode any format through ffmpeg.
+func (a *Audio) Launch() error {
+	binary := filepath.Join(config.BinDir(), "whisper-server")
+	args := []string{"--model", filepath.Join(config.Dir(), "whisper.bin"), "--host", "localhost", "--port", strconv.Itoa(a.port), "--convert"}
+	return process.Fork("Whisper", binary, args)
+}
+
+func (a *Audio) Origin() content.Origin {
+	return content.AUDIO
+}
+
+func (a *Audio) FetchContent(state map[string]string) ([]content.Content, error) {
+	out := make([]content.Content, 0)
+	err := filepath.WalkDir(a.folder, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !mediaExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stateKey := path + ":modified"
+		modified := fmt.Sprintf("%d", info.ModTime().UnixNano())
+		if state[stateKey] == modified {
+			return nil
+		}
+		// a recording still being written will be picked up on the next run
+		if time.Since(info.ModTime()) < time.Minute {
+			return nil
+		}
+		log.Printf("Transcribing %s", path)
+		segments, err := a.transcribe(path)
+		if err != nil {
+			log.Printf("Failed to transcribe %s: %v", path, err)
+			return nil
+		}
+		fragments := a.fragments(path, info.ModTime(), segments)
+		// a re-transcribed recording replaces its fragments, the ones past its new end go
+		out = append(out, fragments...)
+		out = append(out, removedFragments(path, len(fragments), state)...)
+		state[stateKey] = modified
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", a.folder, err)
+	}
+	// the fragments of deleted recordings go too
+	for stateKey := range state {
+		path, found := strings.CutSuffix(stateKey, ":modified")
+		if !found {
+			continue
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+		out = append(out, removedFragments(path, 0, state)...)
+		delete(state, stateKey)
+		delete(state, path+":fragments")
+	}
+	return out, nil
+}
+
+// removedFragments records that a recording now has count fragments and returns
+// the deletion of the ones it had beyond that.
+func removedFragments(path string, count int, state map[string]string) []content.Content {
+	stateKey := path + ":fragments"
+	previous, _ := strconv.Atoi(state[stateKey])
+	state[stateKey] = strconv.Itoa(count)
+	out := make([]content.Content, 0)
+	for fragment := count; fragment < previous; fragment++ {
+		out = append(out, content.Content{ID: fragmentID(path, fragment), Origin: content.AUDIO, Deleted: true})
+	}
+	return out
+}
+
+func fragmentID(path string, fragment int) string {
+	return fmt.Sprintf("%s#%d", path, fragment)
+}
+
+type segment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+func (a *Audio) transcribe(path string) ([]segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the form is streamed, a recording of several hours isn't held in memory
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		writer.CloseWithError(writeRecordingForm(form, filepath.Base(path), f))
+	}()
+
+	url := fmt.Sprintf("http://localhost:%d/inference", a.port)
+	res, err := a.client.Post(url, form.FormDataContentType(), body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("whisper-server returned %s: %s", res.Status, message)
+	}
+	var transcript struct {
+		Segments []segment `json:"segments"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&transcript); err != nil {
+		return nil, fmt.Errorf("failed to decode transcript: %w", err)
+	}
+	return transcript.Segments, nil
+}
+
+func writeRecordingForm(form *multipart.Writer, name string, recording io.Reader) error {
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, recording); err != nil {
+		return err
+	}
+	form.WriteField("response_format", "verbose_json")
+	form.WriteField("temperature", "0.0")
+	return form.Close()
+}
+
+func timestamp(seconds float64) string {
+	d := time.Duration(seconds) * time.Second
+	if d >= time.Hour {
+		return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%02d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// fragments groups segments into Window long Contents, one Fragment each.
+func (a *Audio) fragments(path string, recorded time.Time, segments []segment) []content.Content {
+	out := make([]content.Content, 0)
+	name := filepath.Base(path)
+	window := a.Window.Seconds()
+	for start := 0; start < len(segments); {
+		end := start + 1
+		for end < len(segments) && segments[end].End-segments[start].Start <= window {
+			end++
+		}
+		first, last := segments[start], segments[end-1]
+		var text strings.Builder
+		for _, s := range segments[start:end] {
+			fmt.Fprintf(&text, "[%s] %s\n", timestamp(s.Start), strings.TrimSpace(s.Text))
+		}
+		fragment := len(out)
+		out = append(out, content.Content{
+			ID:                 fragmentID(path, fragment),
+			URL:                fmt.Sprintf("file://%s#t=%d", path, int(first.Start)),
+			Title:              fmt.Sprintf("%s @ %s", name, timestamp(first.Start)),
+			LastModifiedMillis: recorded.Add(time.Duration(first.Start * float64(time.Second))).UnixMilli(),
+			Fragment:           fragment,
+			Origin:             content.AUDIO,
+			Content:            text.String(),
+			Metadata: map[string]string{
+				"Recording": path,
+				"Start":     timestamp(first.Start),
+				"End":       timestamp(last.End),
+				"Offset":    strconv.Itoa(int(first.Start)),
+			},
+		})
+		start = end
+	}
+	return out
+}
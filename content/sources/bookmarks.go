@@ -0,0 +1,417 @@
+package sources
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pumago/content"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bookmarks indexes the bookmarked pages of a browser, folder paths become tags.
+type Bookmarks struct {
+	path    string
+	browser string
+	// profile tells apart the bookmarks of several profiles of a browser.
+	profile string
+	read    func(path string) ([]bookmark, error)
+	// Limit caps how many bookmarks are downloaded per fetch, oldest first.
+	Limit int
+	Fetch func(url string) (string, error)
+}
+
+type bookmark struct {
+	url         string
+	title       string
+	folders     []string
+	added       time.Time
+	readingList bool
+	preview     string
+}
+
+func newBookmarks(browser string, path string, read func(path string) ([]bookmark, error)) *Bookmarks {
+	profile := filepath.Base(filepath.Dir(path))
+	return &Bookmarks{path: path, browser: browser, profile: profile, read: read, Limit: 100, Fetch: download}
+}
+
+func ChromeBookmarks(path string) *Bookmarks {
+	return newBookmarks("chrome", path, readChromeBookmarks)
+}
+
+func FirefoxBookmarks(placesPath string) *Bookmarks {
+	return newBookmarks("firefox", placesPath, readFirefoxBookmarks)
+}
+
+func SafariBookmarks() *Bookmarks {
+	return newBookmarks("safari", filepath.Join(os.Getenv("HOME"), "Library/Safari/Bookmarks.plist"), readSafariBookmarks)
+}
+
+func AllChromeBookmarks() []*Bookmarks {
+	historyFiles, err := listHistoryFiles()
+	if err != nil {
+		return nil
+	}
+	var out []*Bookmarks
+	for _, history := range historyFiles {
+		out = append(out, ChromeBookmarks(filepath.Join(filepath.Dir(history), "Bookmarks")))
+	}
+	return out
+}
+
+// getFirefoxProfilePath returns the Firefox profiles path based on the OS.
+func getFirefoxProfilePath() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(os.Getenv("HOME"), "Library", "Application Support", "Firefox", "Profiles")
+	case "linux":
+		return filepath.Join(os.Getenv("HOME"), ".mozilla", "firefox")
+	case "windows":
+		return filepath.Join(os.Getenv("APPDATA"), "Mozilla", "Firefox", "Profiles")
+	default:
+		return ""
+	}
+}
+
+func AllFirefoxBookmarks() []*Bookmarks {
+	profilePath := getFirefoxProfilePath()
+	if profilePath == "" {
+		return nil
+	}
+	places, err := filepath.Glob(filepath.Join(profilePath, "*", "places.sqlite"))
+	if err != nil {
+		return nil
+	}
+	var out []*Bookmarks
+	for _, path := range places {
+		out = append(out, FirefoxBookmarks(path))
+	}
+	return out
+}
+
+func (b *Bookmarks) Origin() content.Origin {
+	return content.BOOKMARK
+}
+
+// StateName keeps the state of each browser profile apart, they are fetched
+// concurrently and would write back each other's stale state.
+func (b *Bookmarks) StateName() string {
+	return "bookmark:" + b.browser + ":" + b.path
+}
+
+func (b *Bookmarks) FetchContent(state map[string]string) ([]content.Content, error) {
+	if _, err := os.Stat(b.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	stateKey := b.path + ":last_read"
+	var lastRead int64 = 0
+	if stateValue, ok := state[stateKey]; ok {
+		lastRead, _ = strconv.ParseInt(stateValue, 10, 64)
+	}
+	all, err := b.read(b.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s bookmarks: %w", b.browser, err)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].added.Before(all[j].added) })
+
+	entries := make([]content.Content, 0)
+	for _, item := range all {
+		if !strings.HasPrefix(item.url, "http") {
+			continue
+		}
+		// undated bookmarks (plain Safari bookmarks) are tracked by URL instead
+		seenKey := ""
+		added := item.added.UnixMilli()
+		if item.added.IsZero() {
+			seenKey = b.path + ":seen:" + item.url
+			if _, ok := state[seenKey]; ok {
+				continue
+			}
+			added = time.Now().UnixMilli()
+		} else if added <= lastRead {
+			continue
+		}
+		if len(entries) >= b.Limit {
+			break
+		}
+		log.Printf("Downloading bookmark %s", item.url)
+		data, err := b.Fetch(item.url)
+		if err != nil {
+			log.Printf("Failed to download bookmark %s, indexing title only: %v", item.url, err)
+			data = strings.TrimSpace(item.title + "\n" + item.preview)
+		}
+		metadata := map[string]string{
+			"Bookmarked": "true",
+			"Browser":    b.browser,
+			"Profile":    b.profile,
+			"Folder":     strings.Join(item.folders, "/"),
+			"Tags":       strings.Join(item.folders, ","),
+		}
+		if item.readingList {
+			metadata["ReadingList"] = "true"
+		}
+		entries = append(entries, content.Content{
+			// the same page bookmarked in several browsers or profiles is a bookmark of each
+			ID:                 b.browser + ":" + b.profile + ":" + item.url,
+			URL:                item.url,
+			Title:              item.title,
+			LastModifiedMillis: added,
+			Origin:             content.BOOKMARK,
+			Content:            data,
+			Metadata:           metadata,
+		})
+		if seenKey != "" {
+			state[seenKey] = fmt.Sprintf("%d", added)
+		} else {
+			lastRead = added
+		}
+	}
+	state[stateKey] = fmt.Sprintf("%d", lastRead)
+	return entries, nil
+}
+
+type chromeBookmarkNode struct {
+	Type      string               `json:"type"`
+	Name      string               `json:"name"`
+	URL       string               `json:"url"`
+	DateAdded string               `json:"date_added"`
+	Children  []chromeBookmarkNode `json:"children"`
+}
+
+// chromeEpoch converts microseconds since 1601-01-01 to a time.
+func chromeEpoch(micros int64) time.Time {
+	return time.UnixMicro(micros - 11644473600000000)
+}
+
+func readChromeBookmarks(path string) ([]bookmark, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Roots map[string]json.RawMessage `json:"roots"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	out := make([]bookmark, 0)
+	var walk func(node chromeBookmarkNode, folders []string)
+	walk = func(node chromeBookmarkNode, folders []string) {
+		switch node.Type {
+		case "url":
+			micros, _ := strconv.ParseInt(node.DateAdded, 10, 64)
+			out = append(out, bookmark{url: node.URL, title: node.Name, folders: folders, added: chromeEpoch(micros)})
+		case "folder":
+			path := append(append([]string{}, folders...), node.Name)
+			for _, child := range node.Children {
+				walk(child, path)
+			}
+		}
+	}
+	for _, raw := range file.Roots {
+		var node chromeBookmarkNode
+		if err := json.Unmarshal(raw, &node); err != nil {
+			continue // "sync_transaction_version" and friends are not nodes
+		}
+		walk(node, nil)
+	}
+	return out, nil
+}
+
+var firefoxRoots = map[string]string{
+	"menu":    "Bookmarks Menu",
+	"toolbar": "Bookmarks Toolbar",
+	"unfiled": "Other Bookmarks",
+	"mobile":  "Mobile Bookmarks",
+}
+
+func readFirefoxBookmarks(path string) ([]bookmark, error) {
+	// places.sqlite is locked while Firefox runs, read a copy
+	tmp := filepath.Join(os.TempDir(), fmt.Sprintf("places%d.sqlite", time.Now().UnixNano()))
+	if err := copyFile(path, tmp); err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	db, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	type folder struct {
+		title  string
+		parent int64
+	}
+	folders := make(map[int64]folder)
+	rows, err := db.Query(`SELECT id, parent, COALESCE(title, '') FROM moz_bookmarks WHERE type = 2;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query folders: %w", err)
+	}
+	for rows.Next() {
+		var id, parent int64
+		var title string
+		if err := rows.Scan(&id, &parent, &title); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if name, ok := firefoxRoots[title]; ok {
+			title = name
+		}
+		folders[id] = folder{title: title, parent: parent}
+	}
+	rows.Close()
+
+	pathOf := func(id int64) []string {
+		path := make([]string, 0)
+		for depth := 0; depth < 64; depth++ {
+			f, ok := folders[id]
+			if !ok || f.title == "" {
+				break
+			}
+			path = append([]string{f.title}, path...)
+			id = f.parent
+		}
+		return path
+	}
+
+	rows, err = db.Query(`
+SELECT p.url, COALESCE(b.title, p.title, ''), b.parent, b.dateAdded
+FROM moz_bookmarks b
+INNER JOIN moz_places p ON b.fk = p.id
+WHERE b.type = 1;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bookmarks: %w", err)
+	}
+	defer rows.Close()
+	out := make([]bookmark, 0)
+	for rows.Next() {
+		var item bookmark
+		var parent, added int64
+		if err := rows.Scan(&item.url, &item.title, &parent, &added); err != nil {
+			return nil, err
+		}
+		item.folders = pathOf(parent)
+		item.added = time.UnixMicro(added)
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// plistValue is a generic XML property list value.
+type plistValue struct {
+	kind     string
+	text     string
+	keys     []string
+	children []plistValue
+}
+
+func (v plistValue) get(key string) plistValue {
+	for i, k := range v.keys {
+		if k == key {
+			return v.children[i]
+		}
+	}
+	return plistValue{}
+}
+
+func decodePlist(decoder *xml.Decoder, start xml.StartElement) (plistValue, error) {
+	value := plistValue{kind: start.Name.Local}
+	key := ""
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return value, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "key" {
+				var k string
+				if err := decoder.DecodeElement(&k, &t); err != nil {
+					return value, err
+				}
+				key = k
+				continue
+			}
+			child, err := decodePlist(decoder, t)
+			if err != nil {
+				return value, err
+			}
+			value.keys = append(value.keys, key)
+			value.children = append(value.children, child)
+		case xml.CharData:
+			value.text += string(t)
+		case xml.EndElement:
+			return value, nil
+		}
+	}
+}
+
+func readSafariBookmarks(path string) ([]bookmark, error) {
+	// Bookmarks.plist is binary, let plutil convert it
+	cmd := exec.Command("plutil", "-convert", "xml1", "-o", "-", path)
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert plist: %w", err)
+	}
+	decoder := xml.NewDecoder(strings.NewReader(string(data)))
+	var root plistValue
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("empty plist")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "dict" {
+			root, err = decodePlist(decoder, start)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	out := make([]bookmark, 0)
+	var walk func(node plistValue, folders []string)
+	walk = func(node plistValue, folders []string) {
+		switch node.get("WebBookmarkType").text {
+		case "WebBookmarkTypeLeaf":
+			item := bookmark{
+				url:     node.get("URLString").text,
+				title:   node.get("URIDictionary").get("title").text,
+				folders: folders,
+			}
+			readingList := node.get("ReadingList")
+			if readingList.kind != "" {
+				item.readingList = true
+				item.preview = readingList.get("PreviewText").text
+				item.added, _ = time.Parse(time.RFC3339, readingList.get("DateAdded").text)
+			}
+			out = append(out, item)
+		case "WebBookmarkTypeList":
+			title := node.get("Title").text
+			if title == "com.apple.ReadingList" {
+				title = "Reading List"
+			}
+			path := folders
+			if title != "" {
+				path = append(append([]string{}, folders...), title)
+			}
+			for _, child := range node.get("Children").children {
+				walk(child, path)
+			}
+		}
+	}
+	walk(root, nil)
+	return out, nil
+}
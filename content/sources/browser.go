@@ -119,7 +119,7 @@ func (c *Browser) FetchContent(state map[string]string) ([]content.Content, erro
 	entries := make([]content.Content, 0)
 	for _, item := range history {
 		log.Printf("Downloading content %s", item.url)
-		data, err := c.download(item.url)
+		data, err := download(item.url)
 		if err != nil {
 			log.Printf("Failed to download content %s: %v", item.url, err)
 			return nil, fmt.Errorf("failed to download content %s: %w", item.url, err)
@@ -0,0 +1,481 @@
+package sources
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"pumago/config"
+	"pumago/content"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChatExport imports Slack workspace export ZIPs and Discord JSON exports
+// (DiscordChatExporter format) as CHAT content, one Content per conversation window.
+type ChatExport struct {
+	paths []string
+	// Gap is the silence after which a new conversation window starts.
+	Gap time.Duration
+	// SlackDomain is used to build permalinks, e.g. "myteam.slack.com".
+	SlackDomain string
+}
+
+func ChatExports(paths ...string) *ChatExport {
+	return &ChatExport{paths: paths, Gap: 30 * time.Minute, SlackDomain: "slack.com"}
+}
+
+// DefaultChatExports reads exports dropped into the chat folder of the config dir,
+// returns nil if there is none.
+func DefaultChatExports() *ChatExport {
+	dir := filepath.Join(config.Dir(), "chat")
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	return ChatExports(dir)
+}
+
+func (c *ChatExport) Origin() content.Origin {
+	return content.CHAT
+}
+
+func (c *ChatExport) FetchContent(state map[string]string) ([]content.Content, error) {
+	out := make([]content.Content, 0)
+	for _, p := range c.paths {
+		files := []string{p}
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(p, entry.Name()))
+				}
+			}
+		}
+		for _, file := range files {
+			var entries []content.Content
+			var err error
+			switch strings.ToLower(filepath.Ext(file)) {
+			case ".zip":
+				entries, err = c.importSlack(file, state)
+			case ".json":
+				entries, err = c.importDiscord(file, state)
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to import chat export %s: %w", file, err)
+			}
+			log.Printf("Imported %d conversation windows from %s", len(entries), file)
+			out = append(out, entries...)
+		}
+	}
+	return out, nil
+}
+
+// chatMessage is the platform independent form of a single chat message.
+type chatMessage struct {
+	id     string
+	author string
+	text   string
+	thread string
+	time   time.Time
+}
+
+type chatChannel struct {
+	platform  string
+	space     string
+	id        string
+	name      string
+	permalink func(message chatMessage) string
+}
+
+// windows groups messages into threads and, outside threads, into runs separated by at most gap.
+func windows(messages []chatMessage, gap time.Duration) [][]chatMessage {
+	sort.Slice(messages, func(i, j int) bool { return messages[i].time.Before(messages[j].time) })
+	out := make([][]chatMessage, 0)
+	threads := make(map[string]int)
+	last := -1
+	for _, message := range messages {
+		if message.thread != "" {
+			if i, ok := threads[message.thread]; ok {
+				out[i] = append(out[i], message)
+				continue
+			}
+		}
+		if last >= 0 && message.thread == "" {
+			window := out[last]
+			if message.time.Sub(window[len(window)-1].time) <= gap {
+				out[last] = append(out[last], message)
+				continue
+			}
+		}
+		out = append(out, []chatMessage{message})
+		if message.thread != "" {
+			threads[message.thread] = len(out) - 1
+		} else {
+			last = len(out) - 1
+		}
+	}
+	return out
+}
+
+// maxThreadContext bounds the parent message kept for replies imported later.
+const maxThreadContext = 1000
+
+// toContents turns the messages of a channel newer than the last import into windows.
+// A new reply brings back the rest of its thread, the window keeps the ID of the
+// imported one and replaces it. When the export lacks the thread's start, the
+// parent message saved by an earlier import is quoted instead.
+func (c *ChatExport) toContents(channel chatChannel, messages []chatMessage, state map[string]string) []content.Content {
+	stateKey := fmt.Sprintf("%s:%s:last_read", channel.platform, channel.id)
+	var lastRead int64 = 0
+	if stateValue, ok := state[stateKey]; ok {
+		lastRead, _ = strconv.ParseInt(stateValue, 10, 64)
+	}
+	fresh := make([]chatMessage, 0, len(messages))
+	replied := make(map[string]bool)
+	newest := lastRead
+	for _, message := range messages {
+		millis := message.time.UnixMilli()
+		if millis <= lastRead {
+			continue
+		}
+		if millis > newest {
+			newest = millis
+		}
+		fresh = append(fresh, message)
+		if message.thread != "" {
+			replied[message.thread] = true
+		}
+	}
+	for _, message := range messages {
+		if message.time.UnixMilli() <= lastRead && replied[message.thread] {
+			fresh = append(fresh, message)
+		}
+	}
+	state[stateKey] = fmt.Sprintf("%d", newest)
+
+	out := make([]content.Content, 0)
+	for _, window := range windows(fresh, c.Gap) {
+		first, end := window[0], window[len(window)-1]
+		participants := make([]string, 0)
+		seen := make(map[string]bool)
+		var text strings.Builder
+		if first.thread != "" {
+			threadKey := fmt.Sprintf("%s:%s:thread:%s", channel.platform, channel.id, first.thread)
+			if first.id == first.thread {
+				parent := fmt.Sprintf("%s: %s\n", first.author, first.text)
+				if len(parent) > maxThreadContext {
+					parent = strings.ToValidUTF8(parent[:maxThreadContext], "") + "…\n"
+				}
+				state[threadKey] = parent
+			} else if parent, ok := state[threadKey]; ok {
+				text.WriteString(parent)
+			}
+		}
+		for _, message := range window {
+			if !seen[message.author] {
+				seen[message.author] = true
+				participants = append(participants, message.author)
+			}
+			fmt.Fprintf(&text, "%s: %s\n", message.author, message.text)
+		}
+		metadata := map[string]string{
+			"Platform":     channel.platform,
+			"Space":        channel.space,
+			"Channel":      channel.name,
+			"ChannelID":    channel.id,
+			"Participants": strings.Join(participants, ", "),
+			"Start":        first.time.Format(time.RFC3339),
+			"End":          end.time.Format(time.RFC3339),
+		}
+		if first.thread != "" {
+			metadata["Thread"] = first.thread
+		}
+		out = append(out, content.Content{
+			ID:                 fmt.Sprintf("%s:%s:%s", channel.platform, channel.id, first.id),
+			URL:                channel.permalink(first),
+			Title:              fmt.Sprintf("#%s %s", channel.name, first.time.Format("2006-01-02 15:04")),
+			LastModifiedMillis: end.time.UnixMilli(),
+			Origin:             content.CHAT,
+			Content:            text.String(),
+			Metadata:           metadata,
+		})
+	}
+	return out
+}
+
+type slackUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Profile  struct {
+		DisplayName string `json:"display_name"`
+		RealName    string `json:"real_name"`
+	} `json:"profile"`
+}
+
+func (u slackUser) displayName() string {
+	for _, name := range []string{u.Profile.DisplayName, u.Profile.RealName, u.RealName, u.Name} {
+		if name != "" {
+			return name
+		}
+	}
+	return u.ID
+}
+
+type slackChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type slackMessage struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	User        string `json:"user"`
+	Text        string `json:"text"`
+	Ts          string `json:"ts"`
+	ThreadTs    string `json:"thread_ts"`
+	UserProfile struct {
+		RealName string `json:"real_name"`
+	} `json:"user_profile"`
+}
+
+var slackMarkup = regexp.MustCompile(`<([@#!]?)([^>|]+)(?:\|([^>]*))?>`)
+
+func readZipJSON(file *zip.File, v any) error {
+	r, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func slackTime(ts string) time.Time {
+	seconds, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMicro(int64(seconds * 1e6))
+}
+
+func (c *ChatExport) importSlack(file string, state map[string]string) ([]content.Content, error) {
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	users := make(map[string]string)
+	channels := make(map[string]slackChannel) // folder name -> channel
+	days := make(map[string][]*zip.File)
+	for _, f := range archive.File {
+		dir, name := path.Split(f.Name)
+		dir = strings.Trim(dir, "/")
+		switch {
+		case dir == "" && name == "users.json":
+			var list []slackUser
+			if err := readZipJSON(f, &list); err != nil {
+				return nil, fmt.Errorf("failed to read users: %w", err)
+			}
+			for _, user := range list {
+				users[user.ID] = user.displayName()
+			}
+		case dir == "" && (name == "channels.json" || name == "groups.json" || name == "mpims.json" || name == "dms.json"):
+			var list []slackChannel
+			if err := readZipJSON(f, &list); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			for _, channel := range list {
+				folder := channel.Name
+				if name == "dms.json" || folder == "" {
+					folder = channel.ID
+					channel.Name = channel.ID
+				}
+				channels[folder] = channel
+			}
+		case dir != "" && strings.HasSuffix(name, ".json"):
+			days[dir] = append(days[dir], f)
+		}
+	}
+
+	resolve := func(text string) string {
+		return slackMarkup.ReplaceAllStringFunc(text, func(match string) string {
+			parts := slackMarkup.FindStringSubmatch(match)
+			switch parts[1] {
+			case "@":
+				if name, ok := users[parts[2]]; ok {
+					return "@" + name
+				}
+				return "@" + parts[2]
+			case "#":
+				if parts[3] != "" {
+					return "#" + parts[3]
+				}
+				return "#" + parts[2]
+			case "!":
+				return "@" + parts[2]
+			}
+			if parts[3] != "" {
+				return fmt.Sprintf("%s (%s)", parts[3], parts[2])
+			}
+			return parts[2]
+		})
+	}
+
+	out := make([]content.Content, 0)
+	for folder, files := range days {
+		channel, ok := channels[folder]
+		if !ok {
+			channel = slackChannel{ID: folder, Name: folder}
+		}
+		messages := make([]chatMessage, 0)
+		for _, f := range files {
+			var list []slackMessage
+			if err := readZipJSON(f, &list); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+			}
+			for _, message := range list {
+				if message.Type != "message" || message.Text == "" || message.Subtype == "channel_join" {
+					continue
+				}
+				author := users[message.User]
+				if author == "" {
+					author = message.UserProfile.RealName
+				}
+				if author == "" {
+					author = message.User
+				}
+				messages = append(messages, chatMessage{
+					id:     message.Ts,
+					author: author,
+					text:   resolve(message.Text),
+					thread: message.ThreadTs,
+					time:   slackTime(message.Ts),
+				})
+			}
+		}
+		channelID := channel.ID
+		out = append(out, c.toContents(chatChannel{
+			platform: "slack",
+			space:    strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+			id:       channelID,
+			name:     channel.Name,
+			permalink: func(message chatMessage) string {
+				link := fmt.Sprintf("https://%s/archives/%s/p%s", c.SlackDomain, channelID, strings.Replace(message.id, ".", "", 1))
+				if message.thread != "" && message.thread != message.id {
+					link += "?thread_ts=" + message.thread
+				}
+				return link
+			},
+		}, messages, state)...)
+	}
+	return out, nil
+}
+
+type discordExport struct {
+	Guild struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"guild"`
+	Channel struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Category string `json:"category"`
+	} `json:"channel"`
+	Messages []struct {
+		ID        string    `json:"id"`
+		Type      string    `json:"type"`
+		Timestamp time.Time `json:"timestamp"`
+		Content   string    `json:"content"`
+		Author    struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			Nickname string `json:"nickname"`
+		} `json:"author"`
+		Mentions []struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			Nickname string `json:"nickname"`
+		} `json:"mentions"`
+	} `json:"messages"`
+}
+
+var discordMention = regexp.MustCompile(`<@!?(\d+)>`)
+
+func (c *ChatExport) importDiscord(file string, state map[string]string) ([]content.Content, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var export discordExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, err
+	}
+	if export.Channel.ID == "" {
+		return nil, fmt.Errorf("not a discord export")
+	}
+
+	names := make(map[string]string)
+	for _, message := range export.Messages {
+		names[message.Author.ID] = firstNonEmpty(message.Author.Nickname, message.Author.Name)
+		for _, mention := range message.Mentions {
+			names[mention.ID] = firstNonEmpty(mention.Nickname, mention.Name)
+		}
+	}
+	messages := make([]chatMessage, 0, len(export.Messages))
+	for _, message := range export.Messages {
+		if message.Content == "" {
+			continue
+		}
+		text := discordMention.ReplaceAllStringFunc(message.Content, func(match string) string {
+			id := discordMention.FindStringSubmatch(match)[1]
+			if name, ok := names[id]; ok {
+				return "@" + name
+			}
+			return match
+		})
+		messages = append(messages, chatMessage{
+			id:     message.ID,
+			author: names[message.Author.ID],
+			text:   text,
+			time:   message.Timestamp,
+		})
+	}
+	guildID := export.Guild.ID
+	channelID := export.Channel.ID
+	return c.toContents(chatChannel{
+		platform: "discord",
+		space:    export.Guild.Name,
+		id:       channelID,
+		name:     export.Channel.Name,
+		permalink: func(message chatMessage) string {
+			return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, channelID, message.id)
+		},
+	}, messages, state), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -13,7 +13,8 @@ import (
 	"time"
 )
 
-func (c *Browser) download(url string) (string, error) {
+// download renders a page in a headless browser and returns its text.
+func download(url string) (string, error) {
 	// Set up a context with timeout for cleanup.
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -0,0 +1,81 @@
+package sources
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+var skipTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"head":     true,
+	"svg":      true,
+}
+
+var blockTags = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "section": true, "article": true,
+}
+
+// ExtractHtmlContent returns the visible text of an HTML document.
+func ExtractHtmlContent(data []byte) (string, error) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	var out strings.Builder
+	skipping := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				return strings.TrimSpace(out.String()), nil
+			}
+			return "", fmt.Errorf("failed to parse html: %w", tokenizer.Err())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			if skipTags[tag] {
+				skipping++
+			} else if blockTags[tag] {
+				out.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if skipTags[string(name)] && skipping > 0 {
+				skipping--
+			}
+		case html.TextToken:
+			if skipping == 0 {
+				out.Write(tokenizer.Text())
+				out.WriteString(" ")
+			}
+		}
+	}
+}
+
+// ExtractFileContent extracts text from a file based on its mime type, falling
+// back to the file extension when the mime type is unknown.
+func ExtractFileContent(name string, mimeType string, data []byte) (string, error) {
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	}
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = mimeType
+	}
+	switch {
+	case mediaType == "application/pdf":
+		return ExtractPdfContent(data)
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return ExtractHtmlContent(data)
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/json", mediaType == "application/xml":
+		return string(data), nil
+	default:
+		return "", fmt.Errorf("unsupported file type %s for %s", mediaType, name)
+	}
+}
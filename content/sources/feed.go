@@ -0,0 +1,437 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"golang.org/x/net/html/charset"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pumago/config"
+	"pumago/content"
+	"strings"
+	"time"
+)
+
+// Feed polls RSS 2.0, RSS 1.0 (RDF) and Atom feeds.
+type Feed struct {
+	URLs   []string
+	Client *http.Client
+	// Fetch downloads the full article when the feed only carries a summary.
+	Fetch func(url string) (string, error)
+	// MinLength is the text length under which an entry is considered a summary.
+	MinLength int
+}
+
+func Feeds(urls ...string) *Feed {
+	return &Feed{
+		URLs:      urls,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		Fetch:     download,
+		MinLength: 500,
+	}
+}
+
+// FeedsFromOPML reads the feed URLs of an OPML subscription list.
+func FeedsFromOPML(path string) (*Feed, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Outlines []opmlOutline `xml:"body>outline"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse opml %s: %w", path, err)
+	}
+	urls := make([]string, 0)
+	var walk func(outlines []opmlOutline)
+	walk = func(outlines []opmlOutline) {
+		for _, outline := range outlines {
+			if outline.XMLURL != "" {
+				urls = append(urls, outline.XMLURL)
+			}
+			walk(outline.Outlines)
+		}
+	}
+	walk(doc.Outlines)
+	return Feeds(urls...), nil
+}
+
+type opmlOutline struct {
+	XMLURL   string        `xml:"xmlUrl,attr"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// DefaultFeeds reads feeds.txt (one URL per line) and feeds.opml from the config dir,
+// returns nil if neither has any feed.
+func DefaultFeeds() *Feed {
+	urls := make([]string, 0)
+	if opml, err := FeedsFromOPML(filepath.Join(config.Dir(), "feeds.opml")); err == nil {
+		urls = append(urls, opml.URLs...)
+	}
+	if f, err := os.Open(filepath.Join(config.Dir(), "feeds.txt")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				urls = append(urls, line)
+			}
+		}
+		f.Close()
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	return Feeds(urls...)
+}
+
+func (f *Feed) Origin() content.Origin {
+	return content.FEED
+}
+
+// FetchContent returns the items of the feeds that could be read along with a
+// content.PartialError naming the others.
+func (f *Feed) FetchContent(state map[string]string) ([]content.Content, error) {
+	out := make([]content.Content, 0)
+	var errs []error
+	for _, url := range f.URLs {
+		entries, err := f.fetchFeed(url, state)
+		if err != nil {
+			log.Printf("Failed to fetch feed %s: %v", url, err)
+			errs = append(errs, fmt.Errorf("feed %s: %w", url, err))
+			continue
+		}
+		out = append(out, entries...)
+	}
+	if len(errs) > 0 {
+		return out, content.PartialError{Err: errors.Join(errs...)}
+	}
+	return out, nil
+}
+
+// feedItem is the format independent form of an RSS item or Atom entry.
+type feedItem struct {
+	guid      string
+	title     string
+	link      string
+	author    string
+	text      string
+	published time.Time
+}
+
+func (f *Feed) fetchFeed(url string, state map[string]string) ([]content.Content, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag, ok := state[url+":etag"]; ok {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified, ok := state[url+":last_modified"]; ok {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	feedTitle, items, err := parseFeed(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]content.Content, 0)
+	seenPrefix := url + ":seen:"
+	current := make(map[string]bool)
+	for _, item := range items {
+		if item.guid == "" {
+			item.guid = contentGUID(item)
+		}
+		seenKey := seenPrefix + item.guid
+		current[seenKey] = true
+		if _, ok := state[seenKey]; ok {
+			continue
+		}
+		text := item.text
+		if len(text) < f.MinLength && item.link != "" && f.Fetch != nil {
+			full, err := f.Fetch(item.link)
+			if err != nil {
+				log.Printf("Failed to fetch article %s, using summary: %v", item.link, err)
+			} else {
+				text = full
+			}
+		}
+		if item.published.IsZero() {
+			item.published = time.Now()
+		}
+		link := item.link
+		if link == "" {
+			link = url
+		}
+		out = append(out, content.Content{
+			ID:                 feedItemID(url, item.guid),
+			URL:                link,
+			Title:              item.title,
+			LastModifiedMillis: item.published.UnixMilli(),
+			Origin:             content.FEED,
+			Content:            text,
+			Metadata: map[string]string{
+				"Feed":      feedTitle,
+				"FeedURL":   url,
+				"Author":    item.author,
+				"Published": item.published.Format(time.RFC3339),
+			},
+		})
+		state[seenKey] = fmt.Sprintf("%d", time.Now().Unix())
+	}
+	// items that left the feed won't come back, their keys would pile up
+	for key := range state {
+		if strings.HasPrefix(key, seenPrefix) && !current[key] {
+			delete(state, key)
+		}
+	}
+	if etag := res.Header.Get("ETag"); etag != "" {
+		state[url+":etag"] = etag
+	}
+	if lastModified := res.Header.Get("Last-Modified"); lastModified != "" {
+		state[url+":last_modified"] = lastModified
+	}
+	return out, nil
+}
+
+// maxFeedIDLength is the length over which GUIDs are hashed into the item ID.
+const maxFeedIDLength = 200
+
+// feedItemID keys an item by its feed, GUIDs are only unique within one and
+// plain numbers or titles in some.
+func feedItemID(url string, guid string) string {
+	if len(guid) > maxFeedIDLength {
+		sum := sha1.Sum([]byte(guid))
+		guid = hex.EncodeToString(sum[:])
+	}
+	return url + " " + guid
+}
+
+// contentGUID identifies an item without GUID or link by what it says, its
+// title alone would merge every "Weekly update".
+func contentGUID(item feedItem) string {
+	sum := sha1.Sum([]byte(item.title + "\n" + item.published.String() + "\n" + item.text))
+	return hex.EncodeToString(sum[:])
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	About       string `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# about,attr"`
+	PubDate     string `xml:"pubDate"`
+	Date        string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Author      string `xml:"author"`
+	Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Description string `xml:"description"`
+	Encoded     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+}
+
+type rssDocument struct {
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+// rdfDocument is an RSS 1.0 feed, its items are siblings of the channel.
+type rdfDocument struct {
+	Channel struct {
+		Title string `xml:"title"`
+	} `xml:"channel"`
+	Items []rssItem `xml:"item"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",innerxml"`
+}
+
+type atomDocument struct {
+	Title   string `xml:"title"`
+	Entries []struct {
+		ID        string `xml:"id"`
+		Title     string `xml:"title"`
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+		Links     []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Author struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Summary atomText `xml:"summary"`
+		Content atomText `xml:"content"`
+	} `xml:"entry"`
+}
+
+var feedDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05Z0700",
+}
+
+func parseFeedDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// feedText turns an (often escaped HTML) feed body into plain text.
+func feedText(body string) string {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return ""
+	}
+	text, err := ExtractHtmlContent([]byte(body))
+	if err != nil {
+		return body
+	}
+	return text
+}
+
+func newFeedDecoder(data []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charset.NewReaderLabel
+	decoder.Strict = false
+	return decoder
+}
+
+// parseFeed detects RSS or Atom from the root element and returns the feed title and items.
+func parseFeed(data []byte) (string, []feedItem, error) {
+	decoder := newFeedDecoder(data)
+	var root string
+	for root == "" {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read feed: %w", err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start.Name.Local
+		}
+	}
+
+	items := make([]feedItem, 0)
+	switch root {
+	case "rss":
+		var doc rssDocument
+		if err := newFeedDecoder(data).Decode(&doc); err != nil {
+			return "", nil, fmt.Errorf("failed to parse rss: %w", err)
+		}
+		for _, item := range doc.Channel.Items {
+			items = append(items, item.feedItem())
+		}
+		return strings.TrimSpace(doc.Channel.Title), items, nil
+	case "RDF":
+		var doc rdfDocument
+		if err := newFeedDecoder(data).Decode(&doc); err != nil {
+			return "", nil, fmt.Errorf("failed to parse rdf: %w", err)
+		}
+		for _, item := range doc.Items {
+			items = append(items, item.feedItem())
+		}
+		return strings.TrimSpace(doc.Channel.Title), items, nil
+	case "feed":
+		var doc atomDocument
+		if err := newFeedDecoder(data).Decode(&doc); err != nil {
+			return "", nil, fmt.Errorf("failed to parse atom: %w", err)
+		}
+		for _, entry := range doc.Entries {
+			link := ""
+			for _, l := range entry.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = l.Href
+					break
+				}
+			}
+			body := entry.Content.Body
+			if body == "" {
+				body = entry.Summary.Body
+			}
+			items = append(items, feedItem{
+				guid:      firstNonEmpty(entry.ID, link),
+				title:     strings.TrimSpace(entry.Title),
+				link:      link,
+				author:    entry.Author.Name,
+				text:      feedText(xmlUnescape(body)),
+				published: parseFeedDate(firstNonEmpty(entry.Published, entry.Updated)),
+			})
+		}
+		return strings.TrimSpace(doc.Title), items, nil
+	default:
+		return "", nil, fmt.Errorf("unknown feed format <%s>", root)
+	}
+}
+
+func (item rssItem) feedItem() feedItem {
+	body := item.Encoded
+	if body == "" {
+		body = item.Description
+	}
+	return feedItem{
+		guid:      firstNonEmpty(item.GUID, item.About, item.Link),
+		title:     strings.TrimSpace(item.Title),
+		link:      strings.TrimSpace(item.Link),
+		author:    firstNonEmpty(item.Creator, item.Author),
+		text:      feedText(body),
+		published: parseFeedDate(firstNonEmpty(item.PubDate, item.Date)),
+	}
+}
+
+// xmlUnescape decodes entities left in innerxml bodies (type="html" Atom content).
+func xmlUnescape(body string) string {
+	var out strings.Builder
+	decoder := xml.NewDecoder(strings.NewReader("<x>" + body + "</x>"))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			out.Write(t)
+		case xml.StartElement:
+			if t.Name.Local != "x" {
+				out.WriteString("<" + t.Name.Local + ">")
+			}
+		case xml.EndElement:
+			if t.Name.Local != "x" {
+				out.WriteString("</" + t.Name.Local + ">")
+			}
+		}
+	}
+	return out.String()
+}
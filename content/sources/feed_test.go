@@ -0,0 +1,112 @@
+package sources
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"pumago/content"
+	"strings"
+	"testing"
+)
+
+const testRSS = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test feed</title>
+<item><title>First</title><link>http://example.com/1</link><guid>1</guid>
+<pubDate>Mon, 02 Jan 2006 15:04:05 -0700</pubDate><description>first post</description></item>
+</channel></rss>`
+
+const testRDF = `<?xml version="1.0"?>
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/"
+  xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel rdf:about="http://example.com/"><title>Test RDF</title>
+<items><rdf:Seq><rdf:li rdf:resource="http://example.com/a"/></rdf:Seq></items></channel>
+<item rdf:about="http://example.com/a"><title>A</title><link>http://example.com/a</link>
+<dc:creator>Ann</dc:creator><dc:date>2006-01-02T15:04:05Z</dc:date><description>about a</description></item>
+</rdf:RDF>`
+
+func TestFeedConditionalRequests(t *testing.T) {
+	const etag = `"v1"`
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag && r.Header.Get("If-Modified-Since") == lastModified {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(testRSS))
+	}))
+	defer server.Close()
+
+	feed := Feeds(server.URL)
+	feed.Fetch = nil
+	state := make(map[string]string)
+	entries, err := feed.FetchContent(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != feedItemID(server.URL, "1") || entries[0].Metadata["Feed"] != "Test feed" {
+		t.Fatalf("first fetch returned %+v", entries)
+	}
+	if state[server.URL+":etag"] != etag || state[server.URL+":last_modified"] != lastModified {
+		t.Fatalf("validators not stored: %v", state)
+	}
+
+	entries, err = feed.FetchContent(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unmodified feed returned %d entries", len(entries))
+	}
+	if requests != 2 || notModified != 1 {
+		t.Fatalf("expected 2 requests and 1 not modified, got %d and %d", requests, notModified)
+	}
+}
+
+func TestParseRDF(t *testing.T) {
+	title, items, err := parseFeed([]byte(testRDF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Test RDF" || len(items) != 1 {
+		t.Fatalf("got %q with %d items", title, len(items))
+	}
+	item := items[0]
+	if item.guid != "http://example.com/a" || item.title != "A" || item.author != "Ann" || item.published.IsZero() {
+		t.Fatalf("unexpected item %+v", item)
+	}
+}
+
+func TestFeedReportsBrokenFeedsAndForgetsOldItems(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "gone", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(testRSS))
+	}))
+	defer server.Close()
+
+	feed := Feeds(server.URL+"/broken", server.URL+"/ok")
+	feed.Fetch = nil
+	stale := server.URL + "/ok:seen:0"
+	state := map[string]string{stale: "1"}
+	entries, err := feed.FetchContent(state)
+	var partial content.PartialError
+	if !errors.As(err, &partial) || !strings.Contains(err.Error(), server.URL+"/broken") {
+		t.Fatalf("expected a partial error naming the broken feed, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the item of the working feed, got %d", len(entries))
+	}
+	if _, found := state[stale]; found {
+		t.Fatalf("seen key of an item no longer in the feed was kept")
+	}
+	if _, found := state[server.URL+"/ok:seen:1"]; !found {
+		t.Fatalf("seen key of the current item is missing: %v", state)
+	}
+}
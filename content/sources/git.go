@@ -0,0 +1,355 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pumago/config"
+	"pumago/content"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// GitRepos indexes commit messages with their diffstat and the documentation
+// files at HEAD of local git clones.
+type GitRepos struct {
+	repos []string
+	// MaxCommits bounds the history read for a branch seen for the first time.
+	MaxCommits int
+	// DocExtensions are the files indexed at HEAD, under docs/ or anywhere else.
+	DocExtensions []string
+	// MaxDocSize is the size in bytes over which a documentation file is skipped.
+	MaxDocSize int
+	// CommitURL and FileURL are text/template web links, they get .Remote, .Repo,
+	// .Commit and .Path. Empty templates fall back to GitHub style links.
+	CommitURL string
+	FileURL   string
+}
+
+func GitRepositories(repos ...string) *GitRepos {
+	return &GitRepos{
+		repos:         repos,
+		MaxCommits:    500,
+		DocExtensions: []string{".md", ".markdown", ".rst", ".adoc", ".txt"},
+		MaxDocSize:    1 << 20,
+	}
+}
+
+// DefaultGitRepos reads repository paths (globs allowed) from repos.txt in the
+// config dir, returns nil if there is none.
+func DefaultGitRepos() *GitRepos {
+	f, err := os.Open(filepath.Join(config.Dir(), "repos.txt"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	patterns := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	repos := MatchGitRepos(patterns...)
+	if len(repos) == 0 {
+		return nil
+	}
+	return GitRepositories(repos...)
+}
+
+// MatchGitRepos expands "~/" and globs into the git clones they match.
+func MatchGitRepos(patterns ...string) []string {
+	repos := make([]string, 0)
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "~/") {
+			pattern = filepath.Join(os.Getenv("HOME"), pattern[2:])
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("Invalid repository pattern %s: %v", pattern, err)
+			continue
+		}
+		for _, match := range matches {
+			if _, err := os.Stat(filepath.Join(match, ".git")); err == nil {
+				repos = append(repos, match)
+			}
+		}
+	}
+	return repos
+}
+
+func (g *GitRepos) Origin() content.Origin {
+	return content.GIT
+}
+
+func (g *GitRepos) FetchContent(state map[string]string) ([]content.Content, error) {
+	out := make([]content.Content, 0)
+	for _, repo := range g.repos {
+		entries, err := g.fetchRepo(repo, state)
+		if err != nil {
+			log.Printf("Failed to read git repository %s: %v", repo, err)
+			continue
+		}
+		out = append(out, entries...)
+	}
+	return out, nil
+}
+
+func runGit(repo string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// linkData is what the CommitURL and FileURL templates are executed with.
+type linkData struct {
+	Remote string
+	Repo   string
+	Commit string
+	Path   string
+}
+
+var scpRemote = regexp.MustCompile(`^[\w.-]+@([\w.-]+):(.+)$`)
+
+// webRemote turns a clone URL into the https URL of the repository, or "" when it can't.
+func webRemote(remote string) string {
+	remote = strings.TrimSpace(remote)
+	if matches := scpRemote.FindStringSubmatch(remote); matches != nil {
+		remote = "https://" + matches[1] + "/" + matches[2]
+	}
+	remote = strings.Replace(remote, "ssh://git@", "https://", 1)
+	if !strings.HasPrefix(remote, "http") {
+		return ""
+	}
+	return strings.TrimSuffix(remote, ".git")
+}
+
+func (g *GitRepos) link(tmpl string, fallback string, data linkData) string {
+	if tmpl == "" {
+		if data.Remote == "" {
+			if data.Path != "" {
+				return "file://" + filepath.Join(data.Repo, data.Path)
+			}
+			return "file://" + data.Repo + "#" + data.Commit
+		}
+		tmpl = fallback
+	}
+	t, err := template.New("link").Parse(tmpl)
+	if err != nil {
+		log.Printf("Invalid link template %s: %v", tmpl, err)
+		return "file://" + data.Repo
+	}
+	var out strings.Builder
+	if err := t.Execute(&out, data); err != nil {
+		log.Printf("Failed to render link template %s: %v", tmpl, err)
+		return "file://" + data.Repo
+	}
+	return out.String()
+}
+
+func (g *GitRepos) fetchRepo(repo string, state map[string]string) ([]content.Content, error) {
+	remote, _ := runGit(repo, "remote", "get-url", "origin")
+	links := linkData{Remote: webRemote(remote), Repo: repo}
+
+	refs, err := runGit(repo, "for-each-ref", "--format=%(refname:short) %(objectname)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]content.Content, 0)
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(refs), "\n") {
+		branch, head, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+		stateKey := fmt.Sprintf("%s:%s:last_commit", repo, branch)
+		last := state[stateKey]
+		if last == head {
+			continue
+		}
+		args := []string{"log", "--format=%x1e%H%x1f%an <%ae>%x1f%at%x1f%B%x1f", "--stat"}
+		if last != "" {
+			if _, err := runGit(repo, "merge-base", "--is-ancestor", last, head); err == nil {
+				args = append(args, last+".."+head)
+			} else {
+				// history was rewritten, re-read the recent part of the branch
+				args = append(args, "-n", strconv.Itoa(g.MaxCommits), head)
+			}
+		} else {
+			args = append(args, "-n", strconv.Itoa(g.MaxCommits), head)
+		}
+		history, err := runGit(repo, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range g.parseLog(repo, branch, history, links) {
+			if !seen[entry.ID] {
+				seen[entry.ID] = true
+				out = append(out, entry)
+			}
+		}
+		state[stateKey] = head
+	}
+
+	docs, err := g.fetchDocs(repo, state, links)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, docs...), nil
+}
+
+func (g *GitRepos) parseLog(repo string, branch string, history string, links linkData) []content.Content {
+	out := make([]content.Content, 0)
+	name := filepath.Base(repo)
+	for _, record := range strings.Split(history, "\x1e") {
+		fields := strings.Split(record, "\x1f")
+		if len(fields) < 5 {
+			continue
+		}
+		hash, author, message, stat := fields[0], fields[1], strings.TrimSpace(fields[3]), strings.Trim(fields[4], "\n")
+		seconds, _ := strconv.ParseInt(fields[2], 10, 64)
+		when := time.Unix(seconds, 0)
+		subject, _, _ := strings.Cut(message, "\n")
+
+		links.Commit = hash
+		links.Path = ""
+		metadata := map[string]string{
+			"Repo":   name,
+			"Path":   repo,
+			"Branch": branch,
+			"Commit": hash,
+			"Author": author,
+			"Kind":   "commit",
+		}
+		if lines := strings.Split(stat, "\n"); len(lines) > 0 {
+			metadata["Diffstat"] = strings.TrimSpace(lines[len(lines)-1])
+		}
+		out = append(out, content.Content{
+			ID:                 fmt.Sprintf("%s@%s", repo, hash),
+			URL:                g.link(g.CommitURL, "{{.Remote}}/commit/{{.Commit}}", links),
+			Title:              fmt.Sprintf("%s: %s", name, subject),
+			LastModifiedMillis: when.UnixMilli(),
+			Origin:             content.GIT,
+			Content:            fmt.Sprintf("commit %s\nAuthor: %s\nDate: %s\n\n%s\n\n%s", hash, author, when.Format(time.RFC3339), message, stat),
+			Metadata:           metadata,
+		})
+	}
+	return out
+}
+
+// isDoc reports whether a path is a documentation file, images and other
+// binaries under docs/ aren't.
+func (g *GitRepos) isDoc(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, docExt := range g.DocExtensions {
+		if ext == docExt {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDocs indexes the documentation files changed at HEAD since the last fetch,
+// a changed file replaces its previous version and a deleted one is removed.
+func (g *GitRepos) fetchDocs(repo string, state map[string]string, links linkData) ([]content.Content, error) {
+	head, err := runGit(repo, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	head = strings.TrimSpace(head)
+	stateKey := repo + ":docs_commit"
+	last := state[stateKey]
+	if last == head {
+		return nil, nil
+	}
+	changed := make(map[string]bool)
+	if last != "" {
+		// a renamed file is the deletion of its old path
+		diff, err := runGit(repo, "diff", "--name-only", "--no-renames", last, head)
+		if err != nil {
+			last = "" // unknown commit, re-read everything
+		}
+		for _, path := range strings.Split(strings.TrimSpace(diff), "\n") {
+			changed[path] = true
+		}
+	}
+
+	files, err := runGit(repo, "ls-tree", "-r", "-l", head)
+	if err != nil {
+		return nil, err
+	}
+	commitTime, _ := runGit(repo, "log", "-1", "--format=%at", head)
+	seconds, _ := strconv.ParseInt(strings.TrimSpace(commitTime), 10, 64)
+	name := filepath.Base(repo)
+
+	out := make([]content.Content, 0)
+	present := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(files), "\n") {
+		// "<mode> <type> <object> <size>\t<path>"
+		meta, path, found := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if !found || len(fields) != 4 || fields[1] != "blob" || !g.isDoc(path) {
+			continue
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil || size > g.MaxDocSize {
+			continue
+		}
+		present[path] = true
+		if last != "" && !changed[path] {
+			continue
+		}
+		blob := fields[2]
+		data, err := runGit(repo, "cat-file", "blob", blob)
+		if err != nil {
+			return nil, err
+		}
+		if strings.IndexByte(data, 0) >= 0 {
+			// binary, e.g. a UTF-16 file, the embedding would be garbage
+			delete(present, path)
+			continue
+		}
+		links.Commit = head
+		links.Path = path
+		out = append(out, content.Content{
+			ID:                 docID(repo, path),
+			URL:                g.link(g.FileURL, "{{.Remote}}/blob/{{.Commit}}/{{.Path}}", links),
+			Title:              fmt.Sprintf("%s: %s", name, path),
+			LastModifiedMillis: time.Unix(seconds, 0).UnixMilli(),
+			Origin:             content.GIT,
+			Content:            data,
+			Metadata: map[string]string{
+				"Repo":   name,
+				"Path":   repo,
+				"File":   path,
+				"Commit": head,
+				"Kind":   "doc",
+			},
+		})
+	}
+	for path := range changed {
+		if path != "" && !present[path] && g.isDoc(path) {
+			out = append(out, content.Content{ID: docID(repo, path), Origin: content.GIT, Deleted: true})
+		}
+	}
+	state[stateKey] = head
+	return out, nil
+}
+
+// docID keys a documentation file by its path, every version has the same ID.
+func docID(repo string, path string) string {
+	return fmt.Sprintf("%s:%s", repo, path)
+}
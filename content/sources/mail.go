@@ -0,0 +1,477 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/net/html/charset"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"pumago/config"
+	"pumago/content"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mail reads local mbox files and Maildir directories.
+type Mail struct {
+	paths []string
+}
+
+func LocalMail(paths ...string) *Mail {
+	return &Mail{paths: paths}
+}
+
+// DefaultMail looks for mail in the usual locations, returns nil if there is none.
+func DefaultMail() *Mail {
+	candidates := []string{
+		filepath.Join(config.Dir(), "mail"),
+		filepath.Join(os.Getenv("HOME"), "Maildir"),
+		filepath.Join(os.Getenv("HOME"), "mail"),
+	}
+	var paths []string
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			paths = append(paths, candidate)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return LocalMail(paths...)
+}
+
+func (m *Mail) Origin() content.Origin {
+	return content.EMAIL
+}
+
+func (m *Mail) FetchContent(state map[string]string) ([]content.Content, error) {
+	threads := newMailThreads(state)
+	out := make([]content.Content, 0)
+	for _, path := range m.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Skipping mail path %s: %v", path, err)
+			continue
+		}
+		var entries []content.Content
+		if info.IsDir() {
+			entries, err = m.fetchDir(path, state, threads)
+		} else {
+			entries, err = m.fetchMbox(path, state, threads)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mail from %s: %w", path, err)
+		}
+		out = append(out, entries...)
+	}
+	// replies may come before their parent, threads are known once all are read
+	threads.resolve(out)
+	return out, nil
+}
+
+func isMaildir(path string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if info, err := os.Stat(filepath.Join(path, sub)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchDir reads a Maildir (including Maildir++ sub folders) or a directory of mbox files.
+func (m *Mail) fetchDir(path string, state map[string]string, threads *mailThreads) ([]content.Content, error) {
+	if isMaildir(path) {
+		return m.fetchMaildir(path, state, threads)
+	}
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]content.Content, 0)
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") && !isMaildir(filepath.Join(path, file.Name())) {
+			continue
+		}
+		var entries []content.Content
+		full := filepath.Join(path, file.Name())
+		if file.IsDir() {
+			entries, err = m.fetchDir(full, state, threads)
+		} else {
+			entries, err = m.fetchMbox(full, state, threads)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, entries...)
+	}
+	return out, nil
+}
+
+func (m *Mail) fetchMaildir(path string, state map[string]string, threads *mailThreads) ([]content.Content, error) {
+	stateKey := path + ":last_read"
+	var lastRead int64 = 0
+	if stateValue, ok := state[stateKey]; ok {
+		lastRead, _ = strconv.ParseInt(stateValue, 10, 64)
+	}
+	newest := lastRead
+	out := make([]content.Content, 0)
+	folders := []string{filepath.Join(path, "new"), filepath.Join(path, "cur")}
+	subdirs, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subdirs {
+		if sub.IsDir() && strings.HasPrefix(sub.Name(), ".") && isMaildir(filepath.Join(path, sub.Name())) {
+			folders = append(folders, filepath.Join(path, sub.Name(), "new"), filepath.Join(path, sub.Name(), "cur"))
+		}
+	}
+	for _, folder := range folders {
+		files, err := os.ReadDir(folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			info, err := file.Info()
+			if err != nil || file.IsDir() {
+				continue
+			}
+			modified := info.ModTime().UnixNano()
+			if modified <= lastRead {
+				continue
+			}
+			if modified > newest {
+				newest = modified
+			}
+			raw, err := os.ReadFile(filepath.Join(folder, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			entry, err := parseMail(raw, threads)
+			if err != nil {
+				log.Printf("Failed to parse mail %s: %v", file.Name(), err)
+				continue
+			}
+			out = append(out, entry)
+		}
+	}
+	state[stateKey] = fmt.Sprintf("%d", newest)
+	return out, nil
+}
+
+// fetchMbox reads messages appended to an mbox file since the last recorded offset.
+func (m *Mail) fetchMbox(path string, state map[string]string, threads *mailThreads) ([]content.Content, error) {
+	stateKey := path + ":offset"
+	var offset int64 = 0
+	if stateValue, ok := state[stateKey]; ok {
+		offset, _ = strconv.ParseInt(stateValue, 10, 64)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < offset {
+		// the mbox was rewritten (e.g. compacted), start over
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	out := make([]content.Content, 0)
+	var message bytes.Buffer
+	flush := func() {
+		if message.Len() == 0 {
+			return
+		}
+		entry, err := parseMail(message.Bytes(), threads)
+		if err != nil {
+			log.Printf("Failed to parse mail in %s: %v", path, err)
+		} else {
+			out = append(out, entry)
+		}
+		message.Reset()
+	}
+
+	reader := bufio.NewReader(f)
+	previousBlank := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if previousBlank && bytes.HasPrefix(line, []byte("From ")) {
+				flush()
+			} else {
+				// mboxrd escapes body lines starting with "From " as ">From "
+				trimmed := bytes.TrimLeft(line, ">")
+				if len(trimmed) < len(line) && bytes.HasPrefix(trimmed, []byte("From ")) {
+					line = line[1:]
+				}
+				message.Write(line)
+			}
+			previousBlank = len(bytes.TrimSpace(line)) == 0
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	flush()
+	state[stateKey] = fmt.Sprintf("%d", info.Size())
+	return out, nil
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func messageIDs(value string) []string {
+	ids := make([]string, 0)
+	for _, field := range strings.Fields(value) {
+		field = strings.Trim(field, "<>,")
+		if field != "" {
+			ids = append(ids, field)
+		}
+	}
+	return ids
+}
+
+// mailThreads finds the root Message-ID of the conversation of each message. The
+// roots of replies are kept in the source state, so a reply fetched later that
+// only names its parent in In-Reply-To joins the parent's thread.
+type mailThreads struct {
+	state map[string]string
+	// parent and first are the last and first Message-ID a message refers to.
+	parent map[string]string
+	first  map[string]string
+	seen   map[string]bool
+}
+
+func newMailThreads(state map[string]string) *mailThreads {
+	return &mailThreads{
+		state:  state,
+		parent: make(map[string]string),
+		first:  make(map[string]string),
+		seen:   make(map[string]bool),
+	}
+}
+
+func (t *mailThreads) add(header mail.Header, id string) {
+	parents := messageIDs(header.Get("References"))
+	parents = append(parents, messageIDs(header.Get("In-Reply-To"))...)
+	t.seen[id] = true
+	if len(parents) > 0 {
+		t.first[id] = parents[0]
+		t.parent[id] = parents[len(parents)-1]
+	}
+}
+
+// root follows the parents read in this fetch up to a message without any, one
+// whose thread is stored, or one not read whose thread References names.
+func (t *mailThreads) root(id string) string {
+	current := id
+	for depth := 0; depth < 100; depth++ {
+		parent, ok := t.parent[current]
+		if !ok {
+			return current
+		}
+		if thread, ok := t.state["thread:"+parent]; ok {
+			return thread
+		}
+		if !t.seen[parent] {
+			return t.first[current]
+		}
+		current = parent
+	}
+	return current
+}
+
+// resolve sets the Thread of the messages read and stores the ones of replies.
+func (t *mailThreads) resolve(entries []content.Content) {
+	for _, entry := range entries {
+		id := entry.Metadata["MessageID"]
+		thread := t.root(id)
+		entry.Metadata["Thread"] = thread
+		if thread != id {
+			t.state["thread:"+id] = thread
+		}
+	}
+}
+
+func parseMail(raw []byte, threads *mailThreads) (content.Content, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return content.Content{}, err
+	}
+	header := msg.Header
+	id := strings.Trim(strings.TrimSpace(header.Get("Message-ID")), "<>")
+	if id == "" {
+		sum := sha1.Sum(raw)
+		id = hex.EncodeToString(sum[:])
+	}
+	subject := decodeHeader(header.Get("Subject"))
+	date, err := header.Date()
+	if err != nil {
+		date = time.Now()
+	}
+
+	body := &mailBody{}
+	err = body.walk(header.Get("Content-Type"), header.Get("Content-Transfer-Encoding"), header.Get("Content-Disposition"), msg.Body)
+	if err != nil {
+		return content.Content{}, err
+	}
+
+	metadata := map[string]string{
+		"From":      decodeHeader(header.Get("From")),
+		"To":        decodeHeader(header.Get("To")),
+		"Subject":   subject,
+		"Date":      date.Format(time.RFC3339),
+		"MessageID": id,
+	}
+	threads.add(header, id)
+	if cc := header.Get("Cc"); cc != "" {
+		metadata["Cc"] = decodeHeader(cc)
+	}
+	if inReplyTo := messageIDs(header.Get("In-Reply-To")); len(inReplyTo) > 0 {
+		metadata["InReplyTo"] = inReplyTo[0]
+	}
+
+	text := fmt.Sprintf("From: %s\nTo: %s\nSubject: %s\n\n%s", metadata["From"], metadata["To"], subject, body.text())
+	return content.Content{
+		ID:                 id,
+		URL:                "message://" + url.PathEscape("<"+id+">"),
+		Title:              subject,
+		LastModifiedMillis: date.UnixMilli(),
+		Origin:             content.EMAIL,
+		Content:            text,
+		Metadata:           metadata,
+	}, nil
+}
+
+type mailBody struct {
+	plain       []string
+	html        []string
+	attachments []string
+}
+
+func (b *mailBody) text() string {
+	parts := b.plain
+	if len(parts) == 0 {
+		parts = b.html
+	}
+	parts = append(parts, b.attachments...)
+	return strings.Join(parts, "\n\n")
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// newlineStripper drops line breaks so base64 bodies can be decoded.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	count, err := n.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:count] {
+		if b != '\r' && b != '\n' {
+			out = append(out, b)
+		}
+	}
+	return len(out), err
+}
+
+func (b *mailBody) walk(contentType string, encoding string, disposition string, r io.Reader) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = b.walk(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(encoding, r))
+	if err != nil {
+		return err
+	}
+	filename := params["name"]
+	dispositionType, dispositionParams, _ := mime.ParseMediaType(disposition)
+	if dispositionParams["filename"] != "" {
+		filename = dispositionParams["filename"]
+	}
+	if dispositionType == "attachment" || (filename != "" && !strings.HasPrefix(mediaType, "text/")) {
+		text, err := ExtractFileContent(filename, mediaType, data)
+		if err != nil {
+			log.Printf("Skipping attachment %s: %v", filename, err)
+			return nil
+		}
+		b.attachments = append(b.attachments, fmt.Sprintf("Attachment %s:\n%s", decodeHeader(filename), text))
+		return nil
+	}
+	if cs := params["charset"]; cs != "" {
+		if converted, err := charset.NewReaderLabel(cs, bytes.NewReader(data)); err == nil {
+			if all, err := io.ReadAll(converted); err == nil {
+				data = all
+			}
+		}
+	}
+	switch mediaType {
+	case "text/plain":
+		b.plain = append(b.plain, string(data))
+	case "text/html":
+		text, err := ExtractHtmlContent(data)
+		if err != nil {
+			return err
+		}
+		b.html = append(b.html, text)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pumago/config"
+	"pumago/content"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Plugin is a source implemented by an external executable.
+//
+// pumago writes {"state": {...}} to the plugin's stdin and closes it. The plugin
+// writes one JSON object per line to stdout, either {"content": {...}} with the
+// fields of content.Content or {"state": {...}} with the updated state map; the
+// last state line wins. The state is only kept when the plugin exits cleanly.
+type Plugin struct {
+	Name    string            `json:"name"`
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+	// OriginName is the origin the plugin's content is stored under, e.g. "chat".
+	OriginName string `json:"origin"`
+	// Timeout bounds a single run, e.g. "5m".
+	Timeout string `json:"timeout"`
+
+	origin  content.Origin
+	timeout time.Duration
+}
+
+// maxStderr is how much of a plugin's stderr is kept for error messages.
+const maxStderr = 4096
+
+func NewPlugin(name string, command string, args ...string) *Plugin {
+	return &Plugin{Name: name, Command: command, Args: args, timeout: 5 * time.Minute}
+}
+
+// DefaultPlugins loads the plugins declared in plugins.json in the config dir.
+func DefaultPlugins() []*Plugin {
+	data, err := os.ReadFile(filepath.Join(config.Dir(), "plugins.json"))
+	if err != nil {
+		return nil
+	}
+	var plugins []*Plugin
+	if err := json.Unmarshal(data, &plugins); err != nil {
+		log.Printf("Failed to parse plugins.json: %v", err)
+		return nil
+	}
+	out := make([]*Plugin, 0, len(plugins))
+	for _, plugin := range plugins {
+		if err := plugin.Init(); err != nil {
+			log.Printf("Skipping plugin %s: %v", plugin.Name, err)
+			continue
+		}
+		out = append(out, plugin)
+	}
+	return out
+}
+
+// Init validates the declared fields, it must be called before the first fetch.
+func (p *Plugin) Init() error {
+	if p.Name == "" || p.Command == "" {
+		return fmt.Errorf("name and command are required")
+	}
+	p.origin = content.UNKNOWN
+	if p.OriginName != "" {
+		origin, err := content.ParseOrigin(p.OriginName)
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+	}
+	p.timeout = 5 * time.Minute
+	if p.Timeout != "" {
+		timeout, err := time.ParseDuration(p.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+		p.timeout = timeout
+	}
+	return nil
+}
+
+func (p *Plugin) Origin() content.Origin {
+	return p.origin
+}
+
+// StateName keeps the plugin's state apart from other sources of the same origin.
+func (p *Plugin) StateName() string {
+	return "plugin:" + p.Name
+}
+
+type pluginLine struct {
+	Content *content.Content  `json:"content"`
+	State   map[string]string `json:"state"`
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n, err := t.Buffer.Write(p)
+	if t.Len() > t.max {
+		t.Next(t.Len() - t.max)
+	}
+	return n, err
+}
+
+func (p *Plugin) FetchContent(state map[string]string) ([]content.Content, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// kill the whole process group so helpers spawned by the plugin die too
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Env = os.Environ()
+	for key, value := range p.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	input, err := json.Marshal(map[string]any{"state": state})
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	stderr := &tailBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %w", p.Name, err)
+	}
+
+	out := make([]content.Content, 0)
+	var newState map[string]string
+	reader := bufio.NewReader(stdout)
+	lineNumber := 0
+	var protocolErr error
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			lineNumber++
+			var parsed pluginLine
+			if err := json.Unmarshal(line, &parsed); err != nil {
+				protocolErr = fmt.Errorf("line %d: %w", lineNumber, err)
+			} else if parsed.Content != nil {
+				entry := *parsed.Content
+				entry.Origin = p.origin
+				entry.Status = content.NEW
+				if entry.ID == "" {
+					protocolErr = fmt.Errorf("line %d: content without id", lineNumber)
+				} else {
+					out = append(out, entry)
+				}
+			} else if parsed.State != nil {
+				newState = parsed.State
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			protocolErr = readErr
+			break
+		}
+	}
+
+	err = cmd.Wait()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return out, fmt.Errorf("plugin %s timed out after %s, returned %d contents: %s", p.Name, p.timeout, len(out), stderrTail(stderr))
+	}
+	if err != nil {
+		// keep what was produced, the state isn't advanced so the next run retries
+		return out, fmt.Errorf("plugin %s failed: %w: %s", p.Name, err, stderrTail(stderr))
+	}
+	if protocolErr != nil {
+		log.Printf("Plugin %s wrote invalid output: %v", p.Name, protocolErr)
+	}
+	if stderr.Len() > 0 {
+		log.Printf("Plugin %s stderr: %s", p.Name, stderrTail(stderr))
+	}
+	for key, value := range newState {
+		state[key] = value
+	}
+	return out, nil
+}
+
+func stderrTail(stderr *tailBuffer) string {
+	return strings.TrimSpace(stderr.String())
+}
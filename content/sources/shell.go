@@ -0,0 +1,348 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"pumago/content"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShellHistory indexes bash, zsh and fish history files and the atuin database,
+// grouping commands into sessions.
+type ShellHistory struct {
+	files     map[string]string // path -> shell
+	atuinPath string
+	// Gap is the idle time after which a new session starts.
+	Gap time.Duration
+}
+
+type shellCommand struct {
+	command string
+	dir     string
+	time    time.Time
+}
+
+func ShellHistories(files map[string]string, atuinPath string) *ShellHistory {
+	return &ShellHistory{files: files, atuinPath: atuinPath, Gap: 20 * time.Minute}
+}
+
+// DefaultShellHistory finds the history files of the current user, returns nil if there is none.
+func DefaultShellHistory() *ShellHistory {
+	home := os.Getenv("HOME")
+	candidates := map[string]string{
+		filepath.Join(home, ".bash_history"):                           "bash",
+		filepath.Join(home, ".zsh_history"):                            "zsh",
+		filepath.Join(home, ".zhistory"):                               "zsh",
+		filepath.Join(home, ".local", "share", "fish", "fish_history"): "fish",
+	}
+	if histfile := os.Getenv("HISTFILE"); histfile != "" {
+		shell := "bash"
+		if strings.Contains(histfile, "zsh") {
+			shell = "zsh"
+		}
+		candidates[histfile] = shell
+	}
+	files := make(map[string]string)
+	for path, shell := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			files[path] = shell
+		}
+	}
+	atuinPath := filepath.Join(home, ".local", "share", "atuin", "history.db")
+	if _, err := os.Stat(atuinPath); err != nil {
+		atuinPath = ""
+	}
+	if len(files) == 0 && atuinPath == "" {
+		return nil
+	}
+	return ShellHistories(files, atuinPath)
+}
+
+func (s *ShellHistory) Origin() content.Origin {
+	return content.SHELL
+}
+
+func (s *ShellHistory) FetchContent(state map[string]string) ([]content.Content, error) {
+	out := make([]content.Content, 0)
+	for path, shell := range s.files {
+		commands, err := s.readHistoryFile(path, shell, state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s history %s: %w", shell, path, err)
+		}
+		out = append(out, s.sessions(path, shell, commands)...)
+	}
+	if s.atuinPath != "" {
+		commands, err := s.readAtuin(state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read atuin history: %w", err)
+		}
+		out = append(out, s.sessions(s.atuinPath, "atuin", commands)...)
+	}
+	return out, nil
+}
+
+// historyTail is how many bytes before the offset of a history file identify
+// where the last fetch stopped.
+const historyTail = 512
+
+// tailFingerprint hashes the lines in the last historyTail bytes before end,
+// as "<length>:<sha1>".
+func tailFingerprint(data []byte, end int) string {
+	start := max(0, end-historyTail)
+	if start > 0 {
+		if newline := bytes.IndexByte(data[start:end], '\n'); newline >= 0 && start+newline+1 < end {
+			start += newline + 1
+		}
+	}
+	sum := sha1.Sum(data[start:end])
+	return fmt.Sprintf("%d:%s", end-start, hex.EncodeToString(sum[:]))
+}
+
+// resumeOffset is where the last fetch stopped in data. When the shell dropped
+// old commands (HISTFILESIZE) the tail read last moved towards the start, it is
+// searched for line by line, and the file is read again if it is gone.
+func resumeOffset(data []byte, offset int, fingerprint string) int {
+	if fingerprint == "" {
+		// state written before fingerprints, only a shrinking file was noticed
+		if offset > len(data) {
+			return 0
+		}
+		return offset
+	}
+	if offset <= len(data) && tailFingerprint(data, offset) == fingerprint {
+		return offset
+	}
+	lengthValue, _, _ := strings.Cut(fingerprint, ":")
+	length, err := strconv.Atoi(lengthValue)
+	if err != nil || length <= 0 {
+		return 0
+	}
+	for end := len(data); end >= length; end-- {
+		if data[end-1] == '\n' && tailFingerprint(data, end) == fingerprint {
+			return end
+		}
+	}
+	return 0
+}
+
+// readHistoryFile parses the complete lines appended to a history file since
+// the last fetch.
+func (s *ShellHistory) readHistoryFile(path string, shell string, state map[string]string) ([]shellCommand, error) {
+	offsetKey, tailKey := path+":offset", path+":tail"
+	offset, _ := strconv.Atoi(state[offsetKey])
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	all, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	offset = resumeOffset(all, offset, state[tailKey])
+	// a command being written is read once its line is complete
+	end := bytes.LastIndexByte(all, '\n') + 1
+	if end < offset {
+		end = offset
+	}
+	data := all[offset:end]
+	state[offsetKey] = strconv.Itoa(end)
+	state[tailKey] = tailFingerprint(all, end)
+
+	var commands []shellCommand
+	switch shell {
+	case "zsh":
+		commands = parseZshHistory(data)
+	case "fish":
+		commands = parseFishHistory(data)
+	default:
+		commands = parseBashHistory(data)
+	}
+	// commands without timestamps are attributed to the time they were found
+	for i := range commands {
+		if commands[i].time.IsZero() {
+			commands[i].time = info.ModTime()
+		}
+	}
+	return commands, nil
+}
+
+func parseBashHistory(data []byte) []shellCommand {
+	out := make([]shellCommand, 0)
+	var when time.Time
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// HISTTIMEFORMAT writes "#<unix seconds>" before each command
+		if strings.HasPrefix(line, "#") {
+			if seconds, err := strconv.ParseInt(line[1:], 10, 64); err == nil {
+				when = time.Unix(seconds, 0)
+				continue
+			}
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		out = append(out, shellCommand{command: line, time: when})
+		when = time.Time{}
+	}
+	return out
+}
+
+func parseZshHistory(data []byte) []shellCommand {
+	out := make([]shellCommand, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var current *shellCommand
+	for scanner.Scan() {
+		line := scanner.Text()
+		if current != nil {
+			// multi-line commands end their lines with a backslash
+			current.command += "\n" + line
+		} else {
+			command := shellCommand{command: line}
+			// extended history: ": <start>:<elapsed>;<command>"
+			if strings.HasPrefix(line, ": ") {
+				if meta, cmd, found := strings.Cut(line[2:], ";"); found {
+					start, _, _ := strings.Cut(meta, ":")
+					if seconds, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64); err == nil {
+						command = shellCommand{command: cmd, time: time.Unix(seconds, 0)}
+					}
+				}
+			}
+			current = &command
+		}
+		if strings.HasSuffix(line, "\\") {
+			continue
+		}
+		if strings.TrimSpace(current.command) != "" {
+			out = append(out, *current)
+		}
+		current = nil
+	}
+	if current != nil {
+		out = append(out, *current)
+	}
+	return out
+}
+
+func parseFishHistory(data []byte) []shellCommand {
+	out := make([]shellCommand, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	unescape := strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "- cmd: "):
+			out = append(out, shellCommand{command: unescape.Replace(strings.TrimPrefix(line, "- cmd: "))})
+		case strings.HasPrefix(line, "  when: ") && len(out) > 0:
+			if seconds, err := strconv.ParseInt(strings.TrimPrefix(line, "  when: "), 10, 64); err == nil {
+				out[len(out)-1].time = time.Unix(seconds, 0)
+			}
+		}
+	}
+	return out
+}
+
+func (s *ShellHistory) readAtuin(state map[string]string) ([]shellCommand, error) {
+	stateKey := s.atuinPath + ":last_read"
+	var lastRead int64 = 0
+	if stateValue, ok := state[stateKey]; ok {
+		lastRead, _ = strconv.ParseInt(stateValue, 10, 64)
+	}
+	tmp := filepath.Join(os.TempDir(), fmt.Sprintf("atuin%d.db", time.Now().UnixNano()))
+	if err := copyFile(s.atuinPath, tmp); err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	db, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT timestamp, command, COALESCE(cwd, '') FROM history WHERE timestamp > ? AND deleted_at IS NULL ORDER BY timestamp;`, lastRead)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]shellCommand, 0)
+	for rows.Next() {
+		var nanos int64
+		var command shellCommand
+		if err := rows.Scan(&nanos, &command.command, &command.dir); err != nil {
+			return nil, err
+		}
+		command.time = time.Unix(0, nanos)
+		out = append(out, command)
+		lastRead = nanos
+	}
+	state[stateKey] = fmt.Sprintf("%d", lastRead)
+	return out, rows.Err()
+}
+
+// sessions groups commands separated by less than Gap into one redacted Content each.
+func (s *ShellHistory) sessions(path string, shell string, commands []shellCommand) []content.Content {
+	sort.SliceStable(commands, func(i, j int) bool { return commands[i].time.Before(commands[j].time) })
+	out := make([]content.Content, 0)
+	for start := 0; start < len(commands); {
+		end := start + 1
+		for end < len(commands) && commands[end].time.Sub(commands[end-1].time) <= s.Gap {
+			end++
+		}
+		session := commands[start:end]
+		first, last := session[0], session[len(session)-1]
+
+		dirs := make([]string, 0)
+		seen := make(map[string]bool)
+		var text strings.Builder
+		for _, command := range session {
+			if command.dir != "" && !seen[command.dir] {
+				seen[command.dir] = true
+				dirs = append(dirs, command.dir)
+			}
+			if command.dir != "" {
+				fmt.Fprintf(&text, "[%s] %s $ %s\n", command.time.Format("15:04"), command.dir, command.command)
+			} else {
+				fmt.Fprintf(&text, "[%s] $ %s\n", command.time.Format("15:04"), command.command)
+			}
+		}
+		metadata := map[string]string{
+			"Shell":    shell,
+			"History":  path,
+			"Commands": strconv.Itoa(len(session)),
+			"Start":    first.time.Format(time.RFC3339),
+			"End":      last.time.Format(time.RFC3339),
+		}
+		if len(dirs) > 0 {
+			metadata["Directories"] = strings.Join(dirs, ",")
+		}
+		out = append(out, content.Content{
+			ID:                 fmt.Sprintf("%s:%d", path, first.time.UnixNano()),
+			URL:                "file://" + path,
+			Title:              fmt.Sprintf("%s session %s", shell, first.time.Format("2006-01-02 15:04")),
+			LastModifiedMillis: last.time.UnixMilli(),
+			Origin:             content.SHELL,
+			Content:            content.Redact(text.String()),
+			Metadata:           metadata,
+		})
+		start = end
+	}
+	return out
+}
@@ -0,0 +1,174 @@
+package events
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"pumago/content"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy decides what happens when a subscriber's buffer is full, publishing
+// never waits for a subscriber.
+type Policy int
+
+const (
+	// DropNewest discards the content being published.
+	DropNewest Policy = iota
+	// DropOldest discards the oldest buffered content to make room.
+	DropOldest
+	// Disconnect unsubscribes the slow consumer.
+	Disconnect
+)
+
+func (p Policy) String() string {
+	return [...]string{"drop_newest", "drop_oldest", "disconnect"}[p]
+}
+
+func ParsePolicy(input string) (Policy, error) {
+	switch input {
+	case "drop_newest":
+		return DropNewest, nil
+	case "drop_oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	default:
+		return DropNewest, fmt.Errorf("invalid policy %q, use drop_newest, drop_oldest or disconnect", input)
+	}
+}
+
+// Event is a published content as seen by one subscriber.
+type Event struct {
+	Content content.Content
+	// Score is how well the content matched the subscriber's filter.
+	Score float32
+}
+
+// Filter selects the content a subscriber receives and scores it, a nil Filter
+// receives everything with a score of 1.
+type Filter func(content.Content) (score float32, ok bool)
+
+type Subscription struct {
+	ID      string
+	events  chan Event
+	done    chan struct{}
+	filter  Filter
+	policy  Policy
+	dropped atomic.Int64
+	// lock serializes the sends of concurrent publishers so DropOldest stays correct
+	lock   sync.Mutex
+	closed sync.Once
+}
+
+// Events delivers the published content matching the subscription's filter.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Done is closed once the subscription ended, by Unsubscribe or by the Disconnect policy.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped is how many contents were discarded because the buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// offer delivers data without blocking, it returns false when the subscriber
+// must be disconnected.
+func (s *Subscription) offer(data Event) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case s.events <- data:
+		return true
+	default:
+	}
+	s.dropped.Add(1)
+	switch s.policy {
+	case DropOldest:
+		select {
+		case <-s.events:
+		default:
+		}
+		select {
+		case s.events <- data:
+		default:
+		}
+	case Disconnect:
+		return false
+	}
+	return true
+}
+
+// Bus fans indexed content out to its subscribers, e.g. the /watch streams.
+type Bus struct {
+	lock        sync.RWMutex
+	subscribers map[string]*Subscription
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[string]*Subscription)}
+}
+
+// Subscribe registers a subscriber buffering up to buffer contents.
+func (b *Bus) Subscribe(buffer int, policy Policy, filter Filter) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	s := &Subscription{
+		ID:     uuid.New().String(),
+		events: make(chan Event, buffer),
+		done:   make(chan struct{}),
+		filter: filter,
+		policy: policy,
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers[s.ID] = s
+	return s
+}
+
+// Unsubscribe removes a subscriber, it is safe to call more than once.
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, s.ID)
+	s.closed.Do(func() {
+		close(s.done)
+	})
+}
+
+// Publish offers data to every matching subscriber without blocking.
+func (b *Bus) Publish(data content.Content) {
+	var slow []*Subscription
+	b.lock.RLock()
+	for _, s := range b.subscribers {
+		event := Event{Content: data, Score: 1}
+		if s.filter != nil {
+			score, ok := s.filter(data)
+			if !ok {
+				continue
+			}
+			event.Score = score
+		}
+		if !s.offer(event) {
+			slow = append(slow, s)
+		}
+	}
+	b.lock.RUnlock()
+	for _, s := range slow {
+		log.Printf("Disconnecting slow subscriber %s", s.ID)
+		b.Unsubscribe(s)
+	}
+}
+
+// Len is the number of subscribers.
+func (b *Bus) Len() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.subscribers)
+}
@@ -0,0 +1,61 @@
+package index
+
+import (
+	"pumago/content"
+	"sync"
+)
+
+// bookmarks tracks the URLs bookmarked in any browser, so the same page from
+// another origin (e.g. CHROME history) ranks like its bookmark. It is shared by
+// the copies of an Index.
+type bookmarks struct {
+	lock sync.RWMutex
+	urls map[string]map[string]bool // url -> bookmark ids
+}
+
+func newBookmarks() *bookmarks {
+	return &bookmarks{urls: make(map[string]map[string]bool)}
+}
+
+func isBookmark(data content.Content) bool {
+	return data.Metadata["Bookmarked"] == "true" && data.URL != ""
+}
+
+func (b *bookmarks) add(data content.Content) {
+	if !isBookmark(data) {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.urls[data.URL] == nil {
+		b.urls[data.URL] = make(map[string]bool)
+	}
+	b.urls[data.URL][data.Origin.String()+" "+data.ID] = true
+}
+
+func (b *bookmarks) remove(data content.Content) {
+	if !isBookmark(data) {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ids := b.urls[data.URL]
+	delete(ids, data.Origin.String()+" "+data.ID)
+	if len(ids) == 0 {
+		delete(b.urls, data.URL)
+	}
+}
+
+func (b *bookmarks) has(url string) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.urls[url]) > 0
+}
+
+// AddBookmarks registers bookmarks indexed by an earlier run, their URLs are
+// boosted in every origin.
+func (index *Index) AddBookmarks(contents []content.Content) {
+	for _, data := range contents {
+		index.bookmarks.add(data)
+	}
+}
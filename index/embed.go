@@ -0,0 +1,125 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"pumago/config"
+	"strconv"
+	"time"
+)
+
+// BatchEmbeddingFunc embeds several texts with a single request.
+type BatchEmbeddingFunc func(ctx context.Context, texts []string) ([][]float32, error)
+
+// EmbeddingError is a failed embedding request, Temporary ones are worth retrying.
+type EmbeddingError struct {
+	StatusCode int
+	// RetryAfter is the delay asked for by the provider, 0 when it didn't say.
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *EmbeddingError) Error() string {
+	return fmt.Sprintf("embedding request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary is true for rate limits and server errors.
+func (e *EmbeddingError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// batchEmbeddingFunc builds the batch embedding function of the configured provider,
+// it uses the same endpoints as embeddingFunc.
+func batchEmbeddingFunc(cfg config.Embedding, port int) BatchEmbeddingFunc {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	switch cfg.Provider {
+	case "ollama":
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = "http://localhost:11434/api"
+		}
+		return func(ctx context.Context, texts []string) ([][]float32, error) {
+			var res struct {
+				Embeddings [][]float32 `json:"embeddings"`
+			}
+			err := postEmbeddings(ctx, client, baseURL+"/embed", "", map[string]any{"model": cfg.Model, "input": texts}, &res)
+			if err != nil {
+				return nil, err
+			}
+			return checkEmbeddings(res.Embeddings, len(texts))
+		}
+	default:
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+			if cfg.Provider == "llama" {
+				baseURL = fmt.Sprintf("http://localhost:%d/v1", port)
+			}
+		}
+		return func(ctx context.Context, texts []string) ([][]float32, error) {
+			var res struct {
+				Data []struct {
+					Index     int       `json:"index"`
+					Embedding []float32 `json:"embedding"`
+				} `json:"data"`
+			}
+			err := postEmbeddings(ctx, client, baseURL+"/embeddings", cfg.APIKey, map[string]any{"model": cfg.Model, "input": texts}, &res)
+			if err != nil {
+				return nil, err
+			}
+			embeddings := make([][]float32, len(texts))
+			for _, data := range res.Data {
+				if data.Index >= 0 && data.Index < len(embeddings) {
+					embeddings[data.Index] = data.Embedding
+				}
+			}
+			return checkEmbeddings(embeddings, len(texts))
+		}
+	}
+}
+
+func postEmbeddings(ctx context.Context, client *http.Client, url string, apiKey string, body any, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		retryAfter, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+		return &EmbeddingError{
+			StatusCode: res.StatusCode,
+			RetryAfter: time.Duration(retryAfter) * time.Second,
+			Body:       string(bytes.TrimSpace(message)),
+		}
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func checkEmbeddings(embeddings [][]float32, expected int) ([][]float32, error) {
+	if len(embeddings) != expected {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", expected, len(embeddings))
+	}
+	for i, embedding := range embeddings {
+		if len(embedding) == 0 {
+			return nil, fmt.Errorf("no embedding returned for input %d", i)
+		}
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,76 @@
+package index
+
+import (
+	"log"
+	"pumago/content"
+	"strings"
+)
+
+// Filter restricts which documents a search may return.
+type Filter struct {
+	Origins    []content.Origin
+	Bookmarked bool
+}
+
+// where returns the chromem metadata filters to query, one per origin.
+func (f Filter) where() []map[string]string {
+	base := make(map[string]string)
+	if f.Bookmarked {
+		base[metaPrefix+"Bookmarked"] = "true"
+	}
+	if len(f.Origins) == 0 {
+		return []map[string]string{base}
+	}
+	out := make([]map[string]string, 0, len(f.Origins))
+	for _, origin := range f.Origins {
+		where := map[string]string{"Origin": origin.String()}
+		for key, value := range base {
+			where[key] = value
+		}
+		out = append(out, where)
+	}
+	return out
+}
+
+// ParseFilter extracts filter terms like "origin:chrome,safari" and "is:bookmarked"
+// from a query and returns the remaining query text.
+func ParseFilter(input string) (string, Filter) {
+	var filter Filter
+	words := make([]string, 0)
+	for _, word := range strings.Fields(input) {
+		key, value, found := strings.Cut(word, ":")
+		switch {
+		case found && strings.EqualFold(key, "origin"):
+			for _, name := range strings.Split(value, ",") {
+				origin, err := content.ParseOrigin(name)
+				if err != nil {
+					log.Printf("Ignoring filter: %v", err)
+					continue
+				}
+				filter.Origins = append(filter.Origins, origin)
+			}
+		case found && strings.EqualFold(key, "is") && strings.EqualFold(value, "bookmarked"):
+			filter.Bookmarked = true
+		default:
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " "), filter
+}
+
+// Match reports whether a content passes the filter, for content that isn't
+// searched through the index.
+func (f Filter) Match(data content.Content) bool {
+	if f.Bookmarked && data.Metadata["Bookmarked"] != "true" {
+		return false
+	}
+	if len(f.Origins) == 0 {
+		return true
+	}
+	for _, origin := range f.Origins {
+		if data.Origin == origin {
+			return true
+		}
+	}
+	return false
+}
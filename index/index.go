@@ -9,7 +9,12 @@ import (
 	"path/filepath"
 	"pumago/config"
 	"pumago/content"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,11 +23,21 @@ type Index struct {
 	collection   *chromem.Collection
 	maxChunkSize int
 	db           *chromem.DB
-	SaveOnDirty  bool
-	Thresh       float32
+	embed        chromem.EmbeddingFunc
+	embedBatch   BatchEmbeddingFunc
+	// embeddingModel is the model name reported by the embeddings endpoint.
+	embeddingModel string
+	SaveOnDirty    bool
+	Thresh         float32
+	// BookmarkBoost is added to the similarity of bookmarked documents when ranking.
+	BookmarkBoost float32
+	bookmarks     *bookmarks
 }
 
-var dirtyCount int
+// dirtyCount counts the chunks changed since the last save, ingestion workers
+// update it concurrently.
+var dirtyCount atomic.Int64
+var saveLock sync.Mutex
 var dbFile = filepath.Join(config.Dir(), "vectors.db")
 
 func Clean() {
@@ -33,8 +48,34 @@ func Clean() {
 	}
 }
 func DefaultIndex() Index {
+	defaults := config.Default()
+	defaults.Embedding.APIKey = os.Getenv("OPENAI_API_KEY")
+	return NewIndex(defaults.Index, defaults.Embedding)
+}
+
+// embeddingFunc builds the embedding function of the configured provider.
+func embeddingFunc(cfg config.Embedding, port int) chromem.EmbeddingFunc {
+	switch cfg.Provider {
+	case "ollama":
+		return chromem.NewEmbeddingFuncOllama(cfg.Model, cfg.BaseURL)
+	case "openai-compatible":
+		return chromem.NewEmbeddingFuncOpenAICompat(cfg.BaseURL, cfg.APIKey, cfg.Model, nil)
+	case "llama":
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = fmt.Sprintf("http://localhost:%d/v1", port)
+		}
+		return chromem.NewEmbeddingFuncOpenAICompat(baseURL, cfg.APIKey, cfg.Model, nil)
+	default:
+		return chromem.NewEmbeddingFuncOpenAI(cfg.APIKey, chromem.EmbeddingModelOpenAI(cfg.Model))
+	}
+}
+
+func NewIndex(cfg config.Index, embedding config.Embedding) Index {
 	db := chromem.NewDB()
-	embed := chromem.NewEmbeddingFuncOpenAI(os.Getenv("OPENAI_API_KEY"), "text-embedding-3-small")
+	port := config.EmbeddingPort
+	embed := embeddingFunc(embedding, port)
+	embedBatch := batchEmbeddingFunc(embedding, port)
 	collectionName := "puma-all"
 	var collection *chromem.Collection
 	if _, err := os.Stat(dbFile); !os.IsNotExist(err) {
@@ -53,11 +94,16 @@ func DefaultIndex() Index {
 	}
 
 	index := Index{
-		collection:   collection,
-		port:         9991,
-		db:           db,
-		maxChunkSize: 1024,
-		Thresh:       0.2,
+		collection:     collection,
+		port:           port,
+		db:             db,
+		embed:          embed,
+		embedBatch:     embedBatch,
+		embeddingModel: embedding.Model,
+		maxChunkSize:   cfg.ChunkSize,
+		Thresh:         cfg.Threshold,
+		BookmarkBoost:  cfg.BookmarkBoost,
+		bookmarks:      newBookmarks(),
 	}
 
 	return index
@@ -65,8 +111,30 @@ func DefaultIndex() Index {
 
 // Returns id->content map
 func (index *Index) Query(query string, limit int) ([]content.Content, error) {
+	results, err := index.Search(query, limit, Filter{})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]content.Content, 0, len(results))
+	for _, res := range results {
+		out = append(out, res.Content)
+	}
+	return out, nil
+}
+
+// Result is a matching chunk along with its ranking score.
+type Result struct {
+	Content    content.Content
+	Similarity float32
+	Score      float32
+}
+
+// Search queries the index restricted by filter, ranking bookmarked documents higher.
+// Bookmarks are queried on their own too, so a boosted one ranked just past
+// limit isn't missed, and pages of any origin whose URL is bookmarked are boosted.
+func (index *Index) Search(query string, limit int, filter Filter) ([]Result, error) {
 	ctx := context.Background()
-	out := make([]content.Content, 0)
+	out := make([]Result, 0)
 	c := index.collection
 	if c == nil {
 		log.Printf("collection does not exist")
@@ -79,15 +147,42 @@ func (index *Index) Query(query string, limit int) ([]content.Content, error) {
 		log.Printf("no documents in collection or limit is 0")
 		return out, nil
 	}
+	embedding, err := index.embed(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to embed query: %v", err)
+	}
+	queries := filter.where()
+	if !filter.Bookmarked && index.BookmarkBoost > 0 {
+		queries = append(queries, Filter{Origins: filter.Origins, Bookmarked: true}.where()...)
+	}
+	var docRes []chromem.Result
+	seen := make(map[string]bool)
+	for _, where := range queries {
+		res, err := c.QueryEmbedding(ctx, embedding, limit, where, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query: %v", err)
+		}
+		for _, r := range res {
+			if !seen[r.ID] {
+				seen[r.ID] = true
+				docRes = append(docRes, r)
+			}
+		}
+	}
+
 	var min float32 = 1.0
 	var max float32 = 0.0
-	docRes, err := c.Query(ctx, query, limit, nil, nil)
-
 	for _, res := range docRes {
-
-		//if res.Similarity > 0.7 {
 		if res.Similarity > index.Thresh {
-			out = append(out, docToContent(res.ID, res.Content, res.Metadata))
+			result := Result{
+				Content:    docToContent(res.ID, res.Content, res.Metadata),
+				Similarity: res.Similarity,
+				Score:      res.Similarity,
+			}
+			if result.Content.Metadata["Bookmarked"] == "true" || index.bookmarks.has(result.Content.URL) {
+				result.Score += index.BookmarkBoost
+			}
+			out = append(out, result)
 		}
 		if res.Similarity < min {
 			min = res.Similarity
@@ -95,16 +190,51 @@ func (index *Index) Query(query string, limit int) ([]content.Content, error) {
 		if res.Similarity > max {
 			max = res.Similarity
 		}
-		//}
 	}
 	log.Printf("Min similarity: %f, Max similarity: %f filtered out %d", min, max, len(docRes)-len(out))
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed to query: %v", err)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Score > out[j].Score })
+	if len(out) > limit {
+		out = out[:limit]
 	}
 	return out, nil
 }
 
+// Embed returns the normalized embedding of a text, to compare contents against it.
+func (index *Index) Embed(text string) ([]float32, error) {
+	return index.embed(context.Background(), text)
+}
+
+// EmbedBatch embeds texts with the index's provider, for clients of the embeddings endpoint.
+func (index *Index) EmbedBatch(texts []string) ([][]float32, error) {
+	return index.embedBatch(context.Background(), texts)
+}
+
+func (index *Index) EmbeddingModel() string {
+	return index.embeddingModel
+}
+
+// Similarity is the best similarity between an embedding and the chunks of an
+// indexed content, found is false when the content isn't in the index.
+func (index *Index) Similarity(embedding []float32, data content.Content) (similarity float32, found bool) {
+	ctx := context.Background()
+	similarity = -1
+	for _, doc := range index.doc(data) {
+		chunk, err := index.collection.GetByID(ctx, doc.ID)
+		if err != nil || len(chunk.Embedding) != len(embedding) {
+			continue
+		}
+		// both vectors are normalized, so the dot product is the cosine similarity
+		var dot float32
+		for i := range embedding {
+			dot += embedding[i] * chunk.Embedding[i]
+		}
+		similarity = max(similarity, dot)
+		found = true
+	}
+	return similarity, found
+}
+
 func (index *Index) splitDoc(doc chromem.Document) []chromem.Document {
 	contentLength := len(doc.Content)
 	out := make([]chromem.Document, 0)
@@ -119,18 +249,26 @@ func (index *Index) splitDoc(doc chromem.Document) []chromem.Document {
 	}
 	return out
 }
+
+// metaPrefix namespaces content.Content.Metadata keys inside the index metadata.
+const metaPrefix = "Meta."
+
 func (index *Index) doc(doc content.Content) []chromem.Document {
+	metadata := map[string]string{
+		"Title":              doc.Title,
+		"LastModifiedMillis": fmt.Sprintf("%d", doc.LastModifiedMillis),
+		"Fragment":           fmt.Sprintf("%d", doc.Fragment),
+		"Origin":             doc.Origin.String(),
+		"Status":             doc.Status.String(),
+		"URL":                doc.URL,
+	}
+	for key, value := range doc.Metadata {
+		metadata[metaPrefix+key] = value
+	}
 	return index.splitDoc(chromem.Document{
-		ID:      doc.ID,
-		Content: doc.Content,
-		Metadata: map[string]string{
-			"Title":              doc.Title,
-			"LastModifiedMillis": fmt.Sprintf("%d", doc.LastModifiedMillis),
-			"Fragment":           fmt.Sprintf("%d", doc.Fragment),
-			"Origin":             doc.Origin.String(),
-			"Status":             doc.Status.String(),
-			"URL":                doc.URL,
-		},
+		ID:       doc.ID,
+		Content:  doc.Content,
+		Metadata: metadata,
 	})
 }
 func docToContent(id string, docContent string, metadata map[string]string) content.Content {
@@ -138,6 +276,15 @@ func docToContent(id string, docContent string, metadata map[string]string) cont
 	origin, _ := content.ParseOrigin(metadata["Origin"])
 	status, _ := content.ParseStatus(metadata["Status"])
 	fragment, _ := strconv.Atoi(metadata["Fragment"])
+	var extra map[string]string
+	for key, value := range metadata {
+		if strings.HasPrefix(key, metaPrefix) {
+			if extra == nil {
+				extra = make(map[string]string)
+			}
+			extra[strings.TrimPrefix(key, metaPrefix)] = value
+		}
+	}
 	return content.Content{
 		ID:                 id,
 		Content:            docContent,
@@ -147,6 +294,7 @@ func docToContent(id string, docContent string, metadata map[string]string) cont
 		Origin:             origin,
 		Status:             status,
 		URL:                metadata["URL"],
+		Metadata:           extra,
 	}
 }
 func (index *Index) Add(data content.Content) error {
@@ -155,25 +303,84 @@ func (index *Index) Add(data content.Content) error {
 	docs := index.doc(data)
 	err := c.AddDocuments(ctx, docs, 1)
 	if err == nil {
-		dirtyCount += len(docs)
-		if dirtyCount > 100 {
+		index.bookmarks.add(data)
+		if dirtyCount.Add(int64(len(docs))) > 100 {
 			err = index.SaveIfDirty()
 		}
 	}
 	return err
 }
 
+// maxBatchInputs keeps embedding requests of long documents under the providers' input limits.
+const maxBatchInputs = 256
+
+// AddBatch embeds the chunks of all contents with as few requests as possible and adds them,
+// it doesn't save the index, callers decide when their progress is durable.
+func (index *Index) AddBatch(ctx context.Context, contents []content.Content) error {
+	docs := make([]chromem.Document, 0, len(contents))
+	for _, data := range contents {
+		docs = append(docs, index.doc(data)...)
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	for start := 0; start < len(docs); start += maxBatchInputs {
+		end := min(start+maxBatchInputs, len(docs))
+		texts := make([]string, 0, end-start)
+		for _, doc := range docs[start:end] {
+			texts = append(texts, doc.Content)
+		}
+		embeddings, err := index.embedBatch(ctx, texts)
+		if err != nil {
+			return err
+		}
+		for i, embedding := range embeddings {
+			docs[start+i].Embedding = embedding
+		}
+	}
+	err := index.collection.AddDocuments(ctx, docs, runtime.NumCPU())
+	if err == nil {
+		dirtyCount.Add(int64(len(docs)))
+		for _, data := range contents {
+			index.bookmarks.add(data)
+		}
+	}
+	return err
+}
+
+// Delete removes every chunk of a document from the index.
+func (index *Index) Delete(data content.Content) error {
+	docs := index.doc(data)
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	err := index.collection.Delete(context.Background(), nil, nil, ids...)
+	if err == nil {
+		dirtyCount.Add(int64(len(ids)))
+		index.bookmarks.remove(data)
+	}
+	return err
+}
+
 func (index *Index) SaveIfDirty() error {
-	if dirtyCount == 0 || !index.SaveOnDirty {
+	if dirtyCount.Load() == 0 || !index.SaveOnDirty {
 		return nil
 	}
 	return index.Save()
 }
 func (index *Index) Save() error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+	// chunks added while exporting stay dirty for the next save
+	dirty := dirtyCount.Load()
 	log.Printf("Saving index %d", index.collection.Count())
 	err := index.db.ExportToFile(dbFile, false, "", index.collection.Name)
 	if err == nil {
-		dirtyCount = 0
+		dirtyCount.Add(-dirty)
 	}
 	return err
 }
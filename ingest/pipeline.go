@@ -0,0 +1,412 @@
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"pumago/content"
+	"pumago/index"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pipeline stores new and changed content, embeds it in batches with several
+// workers and fans it out once indexed. Stages are connected by bounded channels
+// so a slow embedding provider pushes back on the sources instead of growing memory.
+//
+// Progress is crash-safe through the content status: rows are inserted NEW and
+// only marked PROCESSED after the index holding them has been saved, so whatever
+// was in flight during a crash is still NEW on the next start.
+type Pipeline struct {
+	DB    content.DB
+	Index *index.Index
+	// Input receives new content from the sources.
+	Input chan content.Content
+	// Indexed is called for every indexed content, from a single goroutine.
+	Indexed func(content.Content)
+
+	Workers   int
+	BatchSize int
+	// BatchWait is how long a partial batch waits for more content.
+	BatchWait time.Duration
+	// Retries is how many times a batch is retried on rate limits and server errors.
+	Retries int
+	// CommitEvery is how often the index is saved and its contents marked PROCESSED.
+	CommitEvery time.Duration
+	// Retry schedules content whose batch failed after Retries, RetryEvery is how
+	// often due content is queued again.
+	Retry      content.RetryPolicy
+	RetryEvery time.Duration
+	// Durable records fetched content in the pending table until it is stored,
+	// so the content queued in Input survives a crash.
+	Durable bool
+
+	stored  chan content.Content
+	batches chan []content.Content
+	indexed chan content.Content
+	// pending holds the indexed contents not saved yet
+	pending []content.Content
+	lock    sync.Mutex
+
+	// pausedUntil holds back every worker while the provider rate limits us (unix nanos)
+	pausedUntil atomic.Int64
+	inFlight    atomic.Int64
+	uncommitted atomic.Int64
+	processed   atomic.Int64
+	failed      atomic.Int64
+	retries     atomic.Int64
+	duplicates  atomic.Int64
+}
+
+// Metrics is a snapshot of the queue depths and counters of the pipeline.
+type Metrics struct {
+	Queued      int   `json:"queued"`
+	Stored      int   `json:"stored"`
+	Batches     int   `json:"batches"`
+	Indexed     int   `json:"indexed"`
+	InFlight    int64 `json:"in_flight"`
+	Uncommitted int64 `json:"uncommitted"`
+	Processed   int64 `json:"processed"`
+	Failed      int64 `json:"failed"`
+	Retries     int64 `json:"retries"`
+	Duplicates  int64 `json:"duplicates"`
+}
+
+func (p *Pipeline) Metrics() Metrics {
+	return Metrics{
+		Queued:      len(p.Input),
+		Stored:      len(p.stored),
+		Batches:     len(p.batches),
+		Indexed:     len(p.indexed),
+		InFlight:    p.inFlight.Load(),
+		Uncommitted: p.uncommitted.Load(),
+		Processed:   p.processed.Load(),
+		Failed:      p.failed.Load(),
+		Retries:     p.retries.Load(),
+		Duplicates:  p.duplicates.Load(),
+	}
+}
+
+// Start launches every stage, it must be called once before content is queued.
+func (p *Pipeline) Start() {
+	if p.Workers < 1 {
+		p.Workers = 1
+	}
+	if p.BatchSize < 1 {
+		p.BatchSize = 1
+	}
+	p.stored = make(chan content.Content, cap(p.Input))
+	p.batches = make(chan []content.Content, p.Workers)
+	p.indexed = make(chan content.Content, cap(p.Input))
+
+	go p.store()
+	go p.batch()
+	for i := 0; i < p.Workers; i++ {
+		go p.work()
+	}
+	go p.commit()
+	if p.RetryEvery > 0 {
+		go p.retryFailed()
+	}
+	log.Printf("Started ingestion with %d workers and batches of %d", p.Workers, p.BatchSize)
+}
+
+// Reindex queues contents already in the database for embedding.
+func (p *Pipeline) Reindex(data content.Content) {
+	p.stored <- data
+}
+
+// Persist records contents about to be queued, a source must only save its state
+// once they are persisted.
+func (p *Pipeline) Persist(contents []content.Content) error {
+	if !p.Durable || len(contents) == 0 {
+		return nil
+	}
+	return p.DB.AddPending(contents)
+}
+
+// Resume queues the work a previous run didn't finish: NEW rows that were stored
+// but not indexed, then the pending content that wasn't stored.
+func (p *Pipeline) Resume() {
+	unfinished, err := p.DB.All(content.NEW)
+	if err != nil {
+		log.Printf("Failed to load unfinished content: %v", err)
+	}
+	var pending []content.Content
+	if p.Durable {
+		pending, err = p.DB.Pending()
+		if err != nil {
+			log.Printf("Failed to load pending content: %v", err)
+		}
+	}
+	if len(unfinished) == 0 && len(pending) == 0 {
+		return
+	}
+	log.Printf("Resuming %d unfinished and %d pending contents", len(unfinished), len(pending))
+	go func() {
+		for _, data := range unfinished {
+			p.Reindex(data)
+		}
+		for _, data := range pending {
+			p.Input <- data
+		}
+	}()
+}
+
+// store inserts new content, replaces the stored version of changed content and
+// removes deleted content. Unchanged content was stored by an earlier run and is dropped.
+func (p *Pipeline) store() {
+	for data := range p.Input {
+		changed, err := p.save(data)
+		if p.Durable {
+			if err := p.DB.RemovePending(data); err != nil {
+				log.Printf("Failed to remove pending content %s: %v", data.ID, err)
+			}
+		}
+		if err != nil {
+			p.failed.Add(1)
+			log.Printf("Didn't store content %s: %v", data.ID, err)
+			continue
+		}
+		if !changed {
+			if !data.Deleted {
+				p.duplicates.Add(1)
+			}
+			continue
+		}
+		p.stored <- data
+	}
+}
+
+// save stores data and returns whether it has to be indexed. The index loses
+// the chunks of a replaced or deleted version first, a shorter version has fewer.
+func (p *Pipeline) save(data content.Content) (bool, error) {
+	if data.Deleted {
+		old, err := p.DB.Get(data.Origin, data.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := p.Index.Delete(old); err != nil {
+			return false, err
+		}
+		log.Printf("Removing deleted content %s", data.ID)
+		return false, p.DB.Delete(data.Origin, data.ID)
+	}
+	addErr := p.DB.Add(data)
+	if addErr == nil {
+		return true, nil
+	}
+	old, err := p.DB.Get(data.Origin, data.ID)
+	if err != nil {
+		return false, addErr
+	}
+	if old.Content == data.Content && old.Title == data.Title && old.URL == data.URL {
+		return false, nil
+	}
+	if err := p.Index.Delete(old); err != nil {
+		return false, err
+	}
+	return true, p.DB.Replace(data)
+}
+
+func (p *Pipeline) batch() {
+	batch := make([]content.Content, 0, p.BatchSize)
+	timer := time.NewTimer(p.BatchWait)
+	timer.Stop()
+	flush := func() {
+		if len(batch) > 0 {
+			p.batches <- batch
+			batch = make([]content.Content, 0, p.BatchSize)
+		}
+	}
+	for {
+		select {
+		case data := <-p.stored:
+			if len(batch) == 0 {
+				timer.Reset(p.BatchWait)
+			}
+			batch = append(batch, data)
+			if len(batch) >= p.BatchSize {
+				timer.Stop()
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+func (p *Pipeline) work() {
+	for batch := range p.batches {
+		p.inFlight.Add(int64(len(batch)))
+		err := p.addWithRetries(batch)
+		if err != nil && len(batch) > 1 {
+			// isolate the content the provider rejects instead of failing the whole batch
+			log.Printf("Batch of %d failed, indexing one by one: %v", len(batch), err)
+			for _, data := range batch {
+				p.finish(data, p.addWithRetries([]content.Content{data}))
+			}
+		} else {
+			for _, data := range batch {
+				p.finish(data, err)
+			}
+		}
+		p.inFlight.Add(-int64(len(batch)))
+	}
+}
+
+func (p *Pipeline) finish(data content.Content, err error) {
+	if err != nil {
+		p.failed.Add(1)
+		log.Printf("Failed to add content %s to index: %v", data.ID, err)
+		if err := p.DB.Failed(data, err, p.Retry); err != nil {
+			log.Printf("Failed to add update database: %v", err)
+		}
+		return
+	}
+	p.indexed <- data
+}
+
+func (p *Pipeline) addWithRetries(batch []content.Content) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if wait := time.Until(time.Unix(0, p.pausedUntil.Load())); wait > 0 {
+			time.Sleep(wait)
+		}
+		err = p.Index.AddBatch(context.Background(), batch)
+		var embeddingErr *index.EmbeddingError
+		if err == nil || !errors.As(err, &embeddingErr) || !embeddingErr.Temporary() || attempt >= p.Retries {
+			return err
+		}
+		p.retries.Add(1)
+		delay := embeddingErr.RetryAfter
+		if delay == 0 {
+			delay = backoff(attempt)
+		}
+		// a rate limit applies to every worker, not just this one
+		until := time.Now().Add(delay).UnixNano()
+		if until > p.pausedUntil.Load() {
+			p.pausedUntil.Store(until)
+		}
+		log.Printf("Embedding provider returned %d, retrying in %s", embeddingErr.StatusCode, delay)
+	}
+}
+
+// backoff doubles from one second up to a minute, with jitter.
+func backoff(attempt int) time.Duration {
+	delay := time.Second << min(attempt, 6)
+	delay = min(delay, time.Minute)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// commit fans indexed content out and periodically makes it durable.
+func (p *Pipeline) commit() {
+	ticker := time.NewTicker(p.CommitEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-p.indexed:
+			p.lock.Lock()
+			p.pending = append(p.pending, data)
+			p.lock.Unlock()
+			p.uncommitted.Add(1)
+			if p.Indexed != nil {
+				p.Indexed(data)
+			}
+		case <-ticker.C:
+			p.Commit()
+		}
+	}
+}
+
+// Commit saves the index and marks the contents it now holds as PROCESSED.
+func (p *Pipeline) Commit() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.pending) == 0 {
+		return
+	}
+	if err := p.Index.Save(); err != nil {
+		log.Printf("Failed to save index, %d contents stay NEW: %v", len(p.pending), err)
+		return
+	}
+	if err := p.DB.ProcessedAll(p.pending); err != nil {
+		log.Printf("Failed to add update database: %v", err)
+		return
+	}
+	p.processed.Add(int64(len(p.pending)))
+	p.uncommitted.Add(-int64(len(p.pending)))
+	p.pending = p.pending[:0]
+}
+
+// retryFailed periodically queues the FAILED content whose backoff has passed.
+func (p *Pipeline) retryFailed() {
+	ticker := time.NewTicker(p.RetryEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		due, err := p.DB.DueForRetry(cap(p.stored))
+		if err != nil {
+			log.Printf("Failed to list content to retry: %v", err)
+			continue
+		}
+		for _, data := range due {
+			if err := p.DB.Requeue(data, false); err != nil {
+				log.Printf("Failed to requeue %s: %v", data.ID, err)
+				continue
+			}
+			p.Reindex(data)
+		}
+		if len(due) > 0 {
+			log.Printf("Retrying %d failed contents", len(due))
+		}
+	}
+}
+
+// Failures lists the FAILED or DEAD content.
+func (p *Pipeline) Failures(status content.Status) ([]content.Failure, error) {
+	return p.DB.Failures(status)
+}
+
+// RetryNow queues a FAILED or DEAD content again with a fresh set of attempts.
+func (p *Pipeline) RetryNow(origin content.Origin, id string) error {
+	data, err := p.DB.Get(origin, id)
+	if err != nil {
+		return err
+	}
+	if data.Status != content.FAILED && data.Status != content.DEAD {
+		return fmt.Errorf("%s is %s, not failed", id, data.Status)
+	}
+	if err := p.DB.Requeue(data, true); err != nil {
+		return err
+	}
+	go p.Reindex(data)
+	return nil
+}
+
+// RetryAll queues every content of the given failed status again and returns how many.
+func (p *Pipeline) RetryAll(status content.Status) (int, error) {
+	failures, err := p.DB.Failures(status)
+	if err != nil {
+		return 0, err
+	}
+	queued := make([]content.Content, 0, len(failures))
+	for _, failure := range failures {
+		if err := p.DB.Requeue(failure.Content, true); err != nil {
+			return len(queued), err
+		}
+		queued = append(queued, failure.Content)
+	}
+	go func() {
+		for _, data := range queued {
+			p.Reindex(data)
+		}
+	}()
+	return len(queued), nil
+}
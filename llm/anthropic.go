@@ -0,0 +1,398 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"pumago/config"
+	"strings"
+	"time"
+)
+
+const (
+	anthropicVersion = "2023-06-01"
+	// anthropicMaxTokens is sent when the request has no limit, the Messages API requires one.
+	anthropicMaxTokens = 4096
+)
+
+// anthropicBackend adapts Anthropic's Messages API to chat completions.
+type anthropicBackend struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+func newAnthropic(cfg config.Backend, client *http.Client) *anthropicBackend {
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com"
+	}
+	return &anthropicBackend{client: client, baseURL: baseURL, apiKey: cfg.APIKey}
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicBlock is a content block: text, a tool_use of the model or the
+// tool_result answering it.
+type anthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	MaxTokens     int                  `json:"max_tokens"`
+	System        string               `json:"system,omitempty"`
+	Messages      []anthropicMessage   `json:"messages"`
+	Temperature   *float32             `json:"temperature,omitempty"`
+	TopP          *float32             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID         string           `json:"id"`
+	Model      string           `json:"model"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      anthropicUsage   `json:"usage"`
+}
+
+// messageText is the text of a message, image parts are dropped.
+func messageText(message openai.ChatCompletionMessage) string {
+	if len(message.MultiContent) == 0 {
+		return message.Content
+	}
+	parts := make([]string, 0, len(message.MultiContent))
+	for _, part := range message.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeText {
+			parts = append(parts, part.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// anthropicBody converts a chat completion request, system messages become the
+// system prompt and consecutive messages of the same role are merged.
+func anthropicBody(req openai.ChatCompletionRequest, stream bool) anthropicRequest {
+	body := anthropicRequest{
+		Model:         req.Model,
+		MaxTokens:     req.MaxTokens,
+		StopSequences: req.Stop,
+		Stream:        stream,
+	}
+	if req.MaxCompletionTokens > 0 {
+		body.MaxTokens = req.MaxCompletionTokens
+	}
+	if body.MaxTokens <= 0 {
+		body.MaxTokens = anthropicMaxTokens
+	}
+	if req.Temperature != 0 {
+		body.Temperature = &req.Temperature
+	}
+	if req.TopP != 0 {
+		body.TopP = &req.TopP
+	}
+	for _, tool := range req.Tools {
+		if tool.Function != nil {
+			body.Tools = append(body.Tools, anthropicTool{Name: tool.Function.Name, Description: tool.Function.Description, InputSchema: tool.Function.Parameters})
+		}
+	}
+	if len(body.Tools) > 0 {
+		body.ToolChoice = anthropicChoice(req.ToolChoice)
+	}
+	system := make([]string, 0)
+	for _, message := range req.Messages {
+		text := messageText(message)
+		role := message.Role
+		blocks := make([]anthropicBlock, 0, 1)
+		if text != "" {
+			blocks = append(blocks, anthropicBlock{Type: "text", Text: text})
+		}
+		switch role {
+		case openai.ChatMessageRoleSystem, "developer":
+			system = append(system, text)
+			continue
+		case openai.ChatMessageRoleAssistant:
+			for _, call := range message.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+		case openai.ChatMessageRoleTool:
+			// tool results are user content answering the tool_use of the same ID
+			role = openai.ChatMessageRoleUser
+			blocks = []anthropicBlock{{Type: "tool_result", ToolUseID: message.ToolCallID, Content: text}}
+		default:
+			role = openai.ChatMessageRoleUser
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		if last := len(body.Messages) - 1; last >= 0 && body.Messages[last].Role == role {
+			body.Messages[last].Content = append(body.Messages[last].Content, blocks...)
+			continue
+		}
+		body.Messages = append(body.Messages, anthropicMessage{Role: role, Content: blocks})
+	}
+	body.System = strings.Join(system, "\n\n")
+	return body
+}
+
+// anthropicChoice converts an OpenAI tool_choice, "none", "auto", "required" or
+// a named function.
+func anthropicChoice(choice any) *anthropicToolChoice {
+	switch choice := choice.(type) {
+	case string:
+		switch choice {
+		case "none":
+			return &anthropicToolChoice{Type: "none"}
+		case "required":
+			return &anthropicToolChoice{Type: "any"}
+		}
+	case openai.ToolChoice:
+		return &anthropicToolChoice{Type: "tool", Name: choice.Function.Name}
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			if name, ok := function["name"].(string); ok {
+				return &anthropicToolChoice{Type: "tool", Name: name}
+			}
+		}
+	}
+	return &anthropicToolChoice{Type: "auto"}
+}
+
+func finishReason(stopReason string) openai.FinishReason {
+	switch stopReason {
+	case "max_tokens":
+		return openai.FinishReasonLength
+	case "tool_use":
+		return openai.FinishReasonToolCalls
+	case "":
+		return openai.FinishReasonNull
+	default:
+		return openai.FinishReasonStop
+	}
+}
+
+// post sends a Messages request, errors come back as *openai.APIError so callers
+// handle every backend alike.
+func (b *anthropicBackend) post(ctx context.Context, body anthropicRequest) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, b.baseURL+"/v1/messages", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("x-api-key", b.apiKey)
+	request.Header.Set("anthropic-version", anthropicVersion)
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		var failure struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		apiError := &openai.APIError{HTTPStatusCode: response.StatusCode, Message: string(data)}
+		if json.Unmarshal(data, &failure) == nil && failure.Error.Message != "" {
+			apiError.Type = failure.Error.Type
+			apiError.Message = failure.Error.Message
+		}
+		return nil, apiError
+	}
+	return response, nil
+}
+
+func (b *anthropicBackend) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	response, err := b.post(ctx, anthropicBody(req, false))
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer response.Body.Close()
+	var message anthropicResponse
+	if err := json.NewDecoder(response.Body).Decode(&message); err != nil {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("invalid anthropic response: %w", err)
+	}
+	var text strings.Builder
+	calls := make([]openai.ToolCall, 0)
+	for _, block := range message.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			calls = append(calls, openai.ToolCall{
+				ID:       block.ID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: block.Name, Arguments: string(block.Input)},
+			})
+		}
+	}
+	if len(calls) == 0 {
+		calls = nil
+	}
+	return openai.ChatCompletionResponse{
+		ID:      message.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   message.Model,
+		Choices: []openai.ChatCompletionChoice{
+			{
+				Message: openai.ChatCompletionMessage{
+					Role:      openai.ChatMessageRoleAssistant,
+					Content:   text.String(),
+					ToolCalls: calls,
+				},
+				FinishReason: finishReason(message.StopReason),
+			},
+		},
+		Usage: openai.Usage{
+			PromptTokens:     message.Usage.InputTokens,
+			CompletionTokens: message.Usage.OutputTokens,
+			TotalTokens:      message.Usage.InputTokens + message.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+func (b *anthropicBackend) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	response, err := b.post(ctx, anthropicBody(req, true))
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	return &anthropicStream{body: response.Body, scanner: scanner, includeUsage: includeUsage, created: time.Now().Unix()}, nil
+}
+
+// anthropicStream turns the Messages server-sent events into chat completion chunks.
+type anthropicStream struct {
+	body         io.ReadCloser
+	scanner      *bufio.Scanner
+	includeUsage bool
+	id           string
+	model        string
+	created      int64
+	usage        anthropicUsage
+	done         bool
+}
+
+type anthropicEvent struct {
+	Type    string            `json:"type"`
+	Message anthropicResponse `json:"message"`
+	Delta   struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (s *anthropicStream) chunk(delta openai.ChatCompletionStreamChoiceDelta, reason openai.FinishReason) openai.ChatCompletionStreamResponse {
+	return openai.ChatCompletionStreamResponse{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: reason}},
+	}
+}
+
+func (s *anthropicStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	for !s.done && s.scanner.Scan() {
+		data, found := strings.CutPrefix(s.scanner.Text(), "data:")
+		if !found {
+			continue
+		}
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return openai.ChatCompletionStreamResponse{}, fmt.Errorf("invalid anthropic event: %w", err)
+		}
+		switch event.Type {
+		case "message_start":
+			s.id = event.Message.ID
+			s.model = event.Message.Model
+			s.usage = event.Message.Usage
+			return s.chunk(openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant}, ""), nil
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" {
+				return s.chunk(openai.ChatCompletionStreamChoiceDelta{Content: event.Delta.Text}, ""), nil
+			}
+		case "message_delta":
+			s.usage.OutputTokens = event.Usage.OutputTokens
+			return s.chunk(openai.ChatCompletionStreamChoiceDelta{}, finishReason(event.Delta.StopReason)), nil
+		case "message_stop":
+			s.done = true
+			if s.includeUsage {
+				// like OpenAI, the usage comes in a last chunk without choices
+				return openai.ChatCompletionStreamResponse{
+					ID:      s.id,
+					Object:  "chat.completion.chunk",
+					Created: s.created,
+					Model:   s.model,
+					Choices: []openai.ChatCompletionStreamChoice{},
+					Usage: &openai.Usage{
+						PromptTokens:     s.usage.InputTokens,
+						CompletionTokens: s.usage.OutputTokens,
+						TotalTokens:      s.usage.InputTokens + s.usage.OutputTokens,
+					},
+				}, nil
+			}
+		case "error":
+			return openai.ChatCompletionStreamResponse{}, &openai.APIError{Type: event.Error.Type, Message: event.Error.Message}
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return openai.ChatCompletionStreamResponse{}, err
+	}
+	return openai.ChatCompletionStreamResponse{}, io.EOF
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
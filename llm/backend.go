@@ -0,0 +1,143 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"pumago/config"
+	"sort"
+	"strings"
+)
+
+// Backend answers chat completions, requests and responses are in OpenAI's
+// format whatever the provider speaks.
+type Backend interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error)
+}
+
+// Stream is a chat completion being streamed, Recv returns io.EOF at its end.
+type Stream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// Route is the backend chosen for a request and the model name it understands.
+type Route struct {
+	Name    string
+	Backend Backend
+	Model   string
+	// ContextWindow is the model's limit in tokens, 0 when unknown.
+	ContextWindow int
+}
+
+type namedBackend struct {
+	backend Backend
+	config  config.Backend
+}
+
+// Router picks a backend from the model of a request, see Resolve.
+type Router struct {
+	backends map[string]namedBackend
+	order    []string
+	// aliases are the keys of the backends' model mappings, the first backend wins.
+	aliases map[string]string
+}
+
+// NewRouter builds the backends of cfg, llama ones are launched.
+func NewRouter(cfg config.LLM) (*Router, error) {
+	router := &Router{backends: make(map[string]namedBackend), aliases: make(map[string]string)}
+	for _, backendConfig := range cfg.AllBackends() {
+		backend, err := newBackend(backendConfig)
+		if err != nil {
+			return nil, fmt.Errorf("llm backend %s: %w", backendConfig.Name, err)
+		}
+		router.backends[backendConfig.Name] = namedBackend{backend: backend, config: backendConfig}
+		router.order = append(router.order, backendConfig.Name)
+		for alias := range backendConfig.Models {
+			if _, found := router.aliases[alias]; !found {
+				router.aliases[alias] = backendConfig.Name
+			}
+		}
+	}
+	return router, nil
+}
+
+func newBackend(cfg config.Backend) (Backend, error) {
+	client := &http.Client{Transport: headerTransport{headers: cfg.Headers, next: http.DefaultTransport}}
+	switch cfg.Provider {
+	case "anthropic":
+		return newAnthropic(cfg, client), nil
+	case "llama":
+		if cfg.BaseURL == "" {
+			if err := Launch(cfg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newOpenAI(cfg, client), nil
+}
+
+// Resolve maps the model of a request to a backend:
+//   - "backend/model" asks the named backend for model
+//   - a key of a backend's models mapping asks that backend for the mapped model
+//   - anything else, e.g. "gpt-4o" or "meta-llama/Llama-3.1-8B", goes to the default backend
+//
+// An empty model is the backend's configured model.
+func (r *Router) Resolve(model string) Route {
+	name := config.DefaultBackendName
+	if prefix, rest, found := strings.Cut(model, "/"); found {
+		if _, ok := r.backends[prefix]; ok {
+			name, model = prefix, rest
+		}
+	} else if aliased, ok := r.aliases[model]; ok {
+		name = aliased
+	}
+	named := r.backends[name]
+	if mapped, ok := named.config.Models[model]; ok {
+		model = mapped
+	}
+	if model == "" {
+		model = named.config.Model
+	}
+	return Route{Name: name, Backend: named.backend, Model: model, ContextWindow: named.config.ContextWindow}
+}
+
+// Models are the names requests can use besides the provider's own: the model
+// mappings and the configured model of every backend as "backend/model".
+func (r *Router) Models() []string {
+	models := make([]string, 0)
+	for _, name := range r.order {
+		cfg := r.backends[name].config
+		if cfg.Model != "" {
+			models = append(models, name+"/"+cfg.Model)
+		}
+		aliases := make([]string, 0, len(cfg.Models))
+		for alias := range cfg.Models {
+			if r.aliases[alias] == name {
+				aliases = append(aliases, alias)
+			}
+		}
+		sort.Strings(aliases)
+		models = append(models, aliases...)
+	}
+	return models
+}
+
+// headerTransport adds the configured headers to every request of a backend.
+type headerTransport struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,23 @@
+package llm
+
+import (
+	"path/filepath"
+	"pumago/config"
+	"pumago/process"
+	"strconv"
+)
+
+// Launch starts a llama-server in chat mode on the backend's port, its model is
+// a gguf file relative to the config directory, chat.gguf by default.
+func Launch(cfg config.Backend) error {
+	model := cfg.Model
+	if model == "" {
+		model = "chat.gguf"
+	}
+	if !filepath.IsAbs(model) {
+		model = filepath.Join(config.Dir(), model)
+	}
+	binary := filepath.Join(config.BinDir(), "llama-server")
+	args := []string{"--model", model, "--host", "localhost", "--port", strconv.Itoa(cfg.Port)}
+	return process.Fork("LLama chat "+cfg.Name, binary, args)
+}
@@ -0,0 +1,42 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"pumago/config"
+)
+
+// defaultBaseURLs are where OpenAI compatible providers listen unless configured.
+var defaultBaseURLs = map[string]string{
+	"openai": "https://api.openai.com/v1",
+	"ollama": "http://localhost:11434/v1",
+	"vllm":   "http://localhost:8000/v1",
+}
+
+// openAIBackend talks to OpenAI or any server implementing its chat completions API.
+type openAIBackend struct {
+	client *openai.Client
+}
+
+func newOpenAI(cfg config.Backend, httpClient *http.Client) *openAIBackend {
+	clientConfig := openai.DefaultConfig(cfg.APIKey)
+	clientConfig.HTTPClient = httpClient
+	clientConfig.BaseURL = cfg.BaseURL
+	if clientConfig.BaseURL == "" {
+		clientConfig.BaseURL = defaultBaseURLs[cfg.Provider]
+		if cfg.Provider == "llama" {
+			clientConfig.BaseURL = fmt.Sprintf("http://localhost:%d/v1", cfg.Port)
+		}
+	}
+	return &openAIBackend{client: openai.NewClientWithConfig(clientConfig)}
+}
+
+func (b *openAIBackend) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return b.client.CreateChatCompletion(ctx, req)
+}
+
+func (b *openAIBackend) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	return b.client.CreateChatCompletionStream(ctx, req)
+}
@@ -0,0 +1,85 @@
+package llm
+
+import (
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+func init() {
+	// the encodings are embedded, nothing is downloaded at runtime
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// o200kPrefixes are the models using o200k_base, every other model is counted
+// with cl100k_base: exact for older OpenAI models and close enough for budgeting
+// the others.
+var o200kPrefixes = []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4", "chatgpt"}
+
+var (
+	encodingsLock sync.Mutex
+	encodings     = make(map[string]*tiktoken.Tiktoken)
+)
+
+// Tokenizer counts tokens the way a model does.
+type Tokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+// TokenizerFor returns the tokenizer of model, the provider's name of the model.
+func TokenizerFor(model string) Tokenizer {
+	name := tiktoken.MODEL_CL100K_BASE
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(strings.ToLower(model), prefix) {
+			name = tiktoken.MODEL_O200K_BASE
+		}
+	}
+	encodingsLock.Lock()
+	defer encodingsLock.Unlock()
+	encoding, found := encodings[name]
+	if !found {
+		var err error
+		encoding, err = tiktoken.GetEncoding(name)
+		if err != nil {
+			log.Printf("Failed to load %s, estimating tokens: %v", name, err)
+		}
+		encodings[name] = encoding
+	}
+	return Tokenizer{encoding: encoding}
+}
+
+// Count returns the number of tokens of text, about one per four characters
+// when the encoding couldn't be loaded.
+func (t Tokenizer) Count(text string) int {
+	if t.encoding == nil {
+		return (len(text) + 3) / 4
+	}
+	return len(t.encoding.EncodeOrdinary(text))
+}
+
+// Truncate returns the start of text up to tokens tokens, cut after a space.
+func (t Tokenizer) Truncate(text string, tokens int) string {
+	if tokens <= 0 {
+		return ""
+	}
+	if t.encoding == nil {
+		if len(text) <= tokens*4 {
+			return text
+		}
+		text = text[:tokens*4]
+	} else {
+		encoded := t.encoding.EncodeOrdinary(text)
+		if len(encoded) <= tokens {
+			return text
+		}
+		text = t.encoding.Decode(encoded[:tokens])
+	}
+	text = strings.ToValidUTF8(text, "")
+	if cut := strings.LastIndexFunc(text, unicode.IsSpace); cut > 0 {
+		text = text[:cut]
+	}
+	return text
+}
@@ -1,85 +1,335 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"github.com/sashabaranov/go-openai"
+	"fmt"
+	"gopkg.in/yaml.v3"
 	"log"
 	"os"
+	"os/signal"
+	"pumago/config"
 	"pumago/content"
 	"pumago/content/sources"
+	"pumago/events"
 	"pumago/index"
+	"pumago/ingest"
+	"pumago/llm"
+	"pumago/process"
+	"pumago/scheduler"
 	"pumago/server"
-	"time"
+	"strings"
+	"syscall"
 )
 
+// configuredSources builds the enabled sources, sources without explicit paths
+// fall back to their default locations.
+func configuredSources(cfg config.Sources) []content.Source {
+	appSources := make([]content.Source, 0)
+
+	if cfg.Safari.Enabled {
+		appSources = append(appSources, sources.SafariBrowser())
+	}
+	if cfg.Chrome.Enabled {
+		for _, browser := range sources.AllChromeProfiles() {
+			appSources = append(appSources, browser)
+		}
+	}
+	if cfg.Bookmarks.Enabled {
+		appSources = append(appSources, sources.SafariBookmarks())
+		for _, bookmarks := range sources.AllChromeBookmarks() {
+			appSources = append(appSources, bookmarks)
+		}
+		for _, bookmarks := range sources.AllFirefoxBookmarks() {
+			appSources = append(appSources, bookmarks)
+		}
+	}
+	if cfg.Drive.Enabled {
+		drive := sources.DefaultDrive()
+		drive.PageSize = cfg.Drive.PageSize
+		appSources = append(appSources, drive)
+	}
+	if cfg.Mail.Enabled {
+		mail := sources.DefaultMail()
+		if len(cfg.Mail.Paths) > 0 {
+			mail = sources.LocalMail(cfg.Mail.Paths...)
+		}
+		if mail != nil {
+			appSources = append(appSources, mail)
+		}
+	}
+	if cfg.ChatExports.Enabled {
+		chats := sources.DefaultChatExports()
+		if len(cfg.ChatExports.Paths) > 0 {
+			chats = sources.ChatExports(cfg.ChatExports.Paths...)
+		}
+		if chats != nil {
+			chats.Gap = cfg.ChatExports.Gap.Duration
+			chats.SlackDomain = cfg.ChatExports.SlackDomain
+			appSources = append(appSources, chats)
+		}
+	}
+	if cfg.Feeds.Enabled {
+		feeds := sources.DefaultFeeds()
+		if len(cfg.Feeds.URLs) > 0 || cfg.Feeds.OPML != "" {
+			feeds = sources.Feeds(cfg.Feeds.URLs...)
+			if cfg.Feeds.OPML != "" {
+				opml, err := sources.FeedsFromOPML(cfg.Feeds.OPML)
+				if err != nil {
+					log.Printf("Failed to read %s: %v", cfg.Feeds.OPML, err)
+				} else {
+					feeds.URLs = append(feeds.URLs, opml.URLs...)
+				}
+			}
+		}
+		if feeds != nil {
+			appSources = append(appSources, feeds)
+		}
+	}
+	if cfg.Shell.Enabled {
+		if shell := sources.DefaultShellHistory(); shell != nil {
+			shell.Gap = cfg.Shell.Gap.Duration
+			appSources = append(appSources, shell)
+		}
+	}
+	if cfg.Git.Enabled {
+		repos := sources.DefaultGitRepos()
+		if len(cfg.Git.Repos) > 0 {
+			repos = sources.GitRepositories(sources.MatchGitRepos(cfg.Git.Repos...)...)
+		}
+		if repos != nil {
+			repos.MaxCommits = cfg.Git.MaxCommits
+			repos.CommitURL = cfg.Git.CommitURL
+			repos.FileURL = cfg.Git.FileURL
+			appSources = append(appSources, repos)
+		}
+	}
+	for _, plugin := range sources.DefaultPlugins() {
+		appSources = append(appSources, plugin)
+	}
+	for _, declared := range cfg.Plugins {
+		plugin := &sources.Plugin{
+			Name:       declared.Name,
+			Command:    declared.Command,
+			Args:       declared.Args,
+			Env:        declared.Env,
+			OriginName: declared.Origin,
+		}
+		if declared.Timeout.Duration > 0 {
+			plugin.Timeout = declared.Timeout.String()
+		}
+		if err := plugin.Init(); err != nil {
+			log.Printf("Skipping plugin %s: %v", declared.Name, err)
+			continue
+		}
+		appSources = append(appSources, plugin)
+	}
+	if cfg.Audio.Enabled {
+		audio := sources.DefaultAudio()
+		if cfg.Audio.Folder != "" {
+			audio = sources.AudioFolder(cfg.Audio.Folder)
+		}
+		if audio != nil {
+			audio.Window = cfg.Audio.Window.Duration
+			if err := audio.Launch(); err != nil {
+				log.Printf("Failed to launch whisper-server: %v", err)
+			} else {
+				appSources = append(appSources, audio)
+			}
+		}
+	}
+	return appSources
+}
+
+// apiKeys returns the keys accepted by the server, api_key has every scope.
+func apiKeys(cfg config.Server) []server.APIKey {
+	keys := make([]server.APIKey, 0, len(cfg.Keys)+1)
+	if cfg.APIKey != "" {
+		keys = append(keys, server.APIKey{Name: "default", Key: cfg.APIKey, Scopes: []server.Scope{server.ScopeAdmin}})
+	}
+	for _, key := range cfg.Keys {
+		scopes := make([]server.Scope, 0, len(key.Scopes))
+		for _, scope := range key.Scopes {
+			scopes = append(scopes, server.Scope(scope))
+		}
+		keys = append(keys, server.APIKey{Name: key.Name, Key: key.Key, Scopes: scopes})
+	}
+	return keys
+}
+
+// promptTemplates parses the builtin prompt templates and the configured ones.
+func promptTemplates(cfg config.RAG) (*server.Prompts, error) {
+	texts := make(map[string]string, len(cfg.Templates))
+	for name, template := range cfg.Templates {
+		text, err := template.Source()
+		if err != nil {
+			return nil, fmt.Errorf("rag.templates.%s: %w", name, err)
+		}
+		texts[name] = text
+	}
+	return server.NewPrompts(texts, cfg.Template)
+}
+
 func main() {
 	flag.Bool("verbose", false, "enable verbose logging")
 	flag.Bool("nosource", false, "Don't start sources")
 	flag.Bool("rebuild-index", false, "Rebuild Indexes From DB")
+	flag.String("config", config.File(), "Path to the config file")
+	flag.Bool("print-config", false, "Print the effective configuration and exit")
 	flag.Parse()
 	nosource := flag.Lookup("nosource").Value.(flag.Getter).Get().(bool)
 	rebuildIndex := flag.Lookup("rebuild-index").Value.(flag.Getter).Get().(bool)
+	configFile := flag.Lookup("config").Value.String()
+	printConfig := flag.Lookup("print-config").Value.(flag.Getter).Get().(bool)
+
+	// the helper servers are killed once the last state is saved
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer stop()
+	defer process.KillAll()
+
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if printConfig {
+		out, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		fmt.Print(string(out))
+		return
+	}
 	if rebuildIndex {
 		index.Clean()
 	}
-	appSources := make([]content.Source, 0)
-
-	appSources = append(appSources, sources.SafariBrowser())
-	for _, browser := range sources.AllChromeProfiles() {
-		appSources = append(appSources, browser)
+	appSources := configuredSources(cfg.Sources)
+	theIndex := index.NewIndex(cfg.Index, cfg.Embedding)
+	if cfg.Embedding.Provider == "llama" {
+		if err := theIndex.Launch(); err != nil {
+			log.Fatalf("Failed to launch llama-server: %v", err)
+		}
+	}
+	chatRouter, err := llm.NewRouter(cfg.LLM)
+	if err != nil {
+		log.Fatalf("Failed to set up chat backends: %v", err)
 	}
-	appSources = append(appSources, sources.DefaultDrive())
-	theIndex := index.DefaultIndex()
-	completions := make(map[string]chan content.Content)
+	prompts, err := promptTemplates(cfg.RAG)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	var retrievals *server.Retrievals
+	if cfg.RAG.CacheSize > 0 && cfg.RAG.CacheTTL.Duration > 0 {
+		retrievals = server.NewRetrievals(cfg.RAG.CacheSize, cfg.RAG.CacheTTL.Duration)
+	}
+	bus := events.NewBus()
+	watchPolicy, err := events.ParsePolicy(cfg.Server.WatchPolicy)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	queue := make(chan content.Content, cfg.Sources.QueueSize)
 	app := App{
-		Index:            theIndex,
-		Sources:          appSources,
-		ScrapeEvery:      5 * time.Minute,
-		ContentQueue:     make(chan content.Content, 1000),
-		DB:               content.DefaultDB(),
-		CompletionQueues: completions,
+		Index:         theIndex,
+		Sources:       appSources,
+		ContentQueue:  queue,
+		DB:            content.DefaultDB(),
+		Events:        bus,
+		ChatRetention: cfg.Chat.Retention.Duration,
 		WebServer: server.WebServer{
-			MyApiKey:     "123456",
-			Port:         8888,
-			OpenAIClient: openai.NewClient(os.Getenv("OPENAI_API_KEY")),
-			Index:        theIndex,
-			Outputs:      completions,
+			Host:        cfg.Server.Host,
+			Keys:        apiKeys(cfg.Server),
+			Port:        cfg.Server.Port,
+			Chat:        chatRouter,
+			QueryLimit:  cfg.Index.QueryLimit,
+			Index:       theIndex,
+			Events:      bus,
+			WatchBuffer: cfg.Server.WatchBuffer,
+			WatchPolicy: watchPolicy,
+			Ingest:      queue,
+
+			ContextTokens:     cfg.RAG.ContextTokens,
+			ContextCandidates: cfg.RAG.Candidates,
+			DuplicateOverlap:  cfg.RAG.Duplicate,
+			Rewrite:           cfg.RAG.Rewrite,
+			RewriteModel:      cfg.RAG.RewriteModel,
+			Retrievals:        retrievals,
+			Prompts:           prompts,
+
+			AgentSteps:   cfg.Agent.MaxSteps,
+			FetchURLs:    cfg.Agent.FetchURLs,
+			FetchPrivate: cfg.Agent.FetchPrivate,
+			FetchTimeout: cfg.Agent.FetchTimeout.Duration,
 		},
 	}
+	app.Pipeline = &ingest.Pipeline{
+		DB:          app.DB,
+		Index:       &app.Index,
+		Input:       queue,
+		Indexed:     bus.Publish,
+		Workers:     cfg.Ingest.Workers,
+		BatchSize:   cfg.Ingest.BatchSize,
+		BatchWait:   cfg.Ingest.BatchWait.Duration,
+		Retries:     cfg.Ingest.Retries,
+		CommitEvery: cfg.Ingest.CommitEvery.Duration,
+		Retry: content.RetryPolicy{
+			MaxAttempts: cfg.Ingest.MaxAttempts,
+			BaseDelay:   cfg.Ingest.RetryDelay.Duration,
+			MaxDelay:    cfg.Ingest.RetryMaxDelay.Duration,
+		},
+		RetryEvery: cfg.Ingest.RetryEvery.Duration,
+		Durable:    cfg.Ingest.DurableQueue,
+	}
+	app.WebServer.Pipeline = app.Pipeline
+	app.WebServer.Documents = &app.DB
+	app.Scheduler = scheduler.New(app.processSource)
+	app.WebServer.Scheduler = app.Scheduler
+	for _, source := range appSources {
+		// bookmarks of each browser profile keep their own state but share the
+		// "bookmark" schedule, plugins are scheduled by their name
+		name := strings.ToLower(source.Origin().String())
+		if plugin, ok := source.(*sources.Plugin); ok {
+			name = strings.ToLower(plugin.StateName())
+		}
+		schedule := cfg.Sources.ScheduleFor(name)
+		_, err := app.Scheduler.Add(name, source, scheduler.Schedule{
+			Every:  schedule.Every.Duration,
+			Cron:   schedule.Cron,
+			Jitter: schedule.Jitter.Duration,
+			// with --nosource sources only run when triggered
+			Paused: schedule.Paused || nosource,
+		})
+		if err != nil {
+			log.Fatalf("Failed to schedule %s: %v", name, err)
+		}
+	}
 
 	log.Printf("Starting App")
-	// Start a worker to process the queue
-	log.Printf("Starting Worker")
-	go app.ProcessQueue()
+	bookmarked, err := app.DB.List(content.BOOKMARK, content.PROCESSED)
+	if err != nil {
+		log.Printf("Failed to list bookmarks: %v", err)
+	}
+	app.Index.AddBookmarks(bookmarked)
+	app.Pipeline.Start()
 
 	if rebuildIndex {
 		log.Printf("Rebuilding Index")
+		// every row becomes NEW and is picked up by Resume
 		err := app.DB.UpdateAll(content.NEW)
 		if err != nil {
 			log.Fatalf("Failed to update all new content: %v", err)
 		}
-		log.Printf("Loading all new content")
-		all, err := app.DB.All(content.NEW)
-		if err != nil {
-			log.Fatalf("Failed to load all new content: %v", err)
-		}
-		for _, c := range all {
-			app.ContentQueue <- c
-		}
-		log.Printf("Done Loading all new content %d", len(all))
 	}
+	app.Pipeline.Resume()
 
 	go app.Index.StartAutoSaver()
-	// Start fetching history every 5 minutes
-	log.Printf("Starting Timer for browser scraper")
-	if !nosource {
-		for _, source := range app.Sources {
-			go app.StartSource(source)
-		}
-	}
+	go app.StartRetention()
+	log.Printf("Starting scheduler for %d sources", len(app.Sources))
+	app.Scheduler.Start()
 
-	app.WebServer.StartWebServer()
+	app.WebServer.StartWebServer(ctx)
+	// a second signal ends pumago right away
+	stop()
 
+	app.Pipeline.Commit()
 	app.Index.SaveIfDirty() //try to do last save
 
 }
@@ -0,0 +1,57 @@
+package process
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+var (
+	childrenLock sync.Mutex
+	children     []*exec.Cmd
+)
+
+// Fork starts a helper server in its own process group, KillAll stops it when
+// pumago shuts down.
+func Fork(name string, binary string, args []string) error {
+	cmd := exec.Command(binary, args...)
+	if flag.Lookup("verbose").Value.String() == "true" {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	log.Printf("Launching %s: %v", name, cmd)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	err := cmd.Start()
+	if err != nil {
+		log.Printf("Error starting %s: %v", name, err)
+		return err
+	}
+	childrenLock.Lock()
+	children = append(children, cmd)
+	childrenLock.Unlock()
+
+	// this is important, otherwise the process becomes in S mode
+	go func() {
+		err := cmd.Wait()
+		fmt.Printf("Cmd %+v finished with error: %v", cmd, err)
+	}()
+
+	return nil
+}
+
+// KillAll kills the process groups of the helper servers started by Fork.
+func KillAll() {
+	childrenLock.Lock()
+	defer childrenLock.Unlock()
+	for _, cmd := range children {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	children = nil
+}
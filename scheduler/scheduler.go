@@ -0,0 +1,257 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"log"
+	"math/rand"
+	"pumago/content"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSource = errors.New("unknown source")
+	ErrRunning       = errors.New("source is already running")
+)
+
+// Schedule decides when a source runs, every Every or on a standard 5 field
+// Cron expression, delayed by up to Jitter so sources don't all start together.
+type Schedule struct {
+	Every  time.Duration
+	Cron   string
+	Jitter time.Duration
+	Paused bool
+}
+
+func (s Schedule) String() string {
+	if s.Cron != "" {
+		return "cron " + s.Cron
+	}
+	return "every " + s.Every.String()
+}
+
+// Status is what the scheduler knows about a source, for the API and /sources.
+type Status struct {
+	Name         string    `json:"name"`
+	Origin       string    `json:"origin"`
+	Schedule     string    `json:"schedule"`
+	Paused       bool      `json:"paused"`
+	Running      bool      `json:"running"`
+	LastRun      time.Time `json:"last_run"`
+	LastDuration string    `json:"last_duration"`
+	LastItems    int       `json:"last_items"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run"`
+}
+
+// RunFunc fetches a source once and returns the number of items it produced.
+type RunFunc func(source content.Source) (int, error)
+
+type job struct {
+	source   content.Source
+	schedule Schedule
+	cron     cron.Schedule
+	// wake asks the job's loop to run now, it holds at most one pending request
+	wake   chan struct{}
+	status Status
+}
+
+// Scheduler runs every source in its own loop, so a source never runs twice at once.
+type Scheduler struct {
+	run     RunFunc
+	lock    sync.Mutex
+	jobs    map[string]*job
+	started bool
+}
+
+func New(run RunFunc) *Scheduler {
+	return &Scheduler{run: run, jobs: make(map[string]*job)}
+}
+
+// Add registers a source under name, a taken name gets a numeric suffix.
+// It returns the name the source was registered under.
+func (s *Scheduler) Add(name string, source content.Source, schedule Schedule) (string, error) {
+	var parsed cron.Schedule
+	if schedule.Cron != "" {
+		var err error
+		parsed, err = cron.ParseStandard(schedule.Cron)
+		if err != nil {
+			return "", fmt.Errorf("invalid cron expression %q: %w", schedule.Cron, err)
+		}
+	} else if schedule.Every <= 0 {
+		return "", fmt.Errorf("schedule of %s needs an interval or a cron expression", name)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	unique := name
+	for i := 2; s.jobs[unique] != nil; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	s.jobs[unique] = &job{
+		source:   source,
+		schedule: schedule,
+		cron:     parsed,
+		wake:     make(chan struct{}, 1),
+		status: Status{
+			Name:     unique,
+			Origin:   source.Origin().String(),
+			Schedule: schedule.String(),
+			Paused:   schedule.Paused,
+		},
+	}
+	if s.started {
+		go s.loop(s.jobs[unique])
+	}
+	return unique, nil
+}
+
+// Start launches the loop of every registered source.
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, j := range s.jobs {
+		go s.loop(j)
+	}
+}
+
+func (s *Scheduler) loop(j *job) {
+	// interval sources run right away like they always did, cron ones wait for their slot
+	next := time.Now().Add(jitter(j.schedule.Jitter))
+	if j.cron != nil {
+		next = s.next(j, time.Now())
+	}
+	for {
+		s.lock.Lock()
+		j.status.NextRun = next
+		s.lock.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			s.lock.Lock()
+			paused := j.status.Paused
+			s.lock.Unlock()
+			if paused {
+				next = s.next(j, time.Now())
+				continue
+			}
+		case <-j.wake:
+			timer.Stop()
+		}
+		s.execute(j)
+		next = s.next(j, time.Now())
+	}
+}
+
+func (s *Scheduler) next(j *job, from time.Time) time.Time {
+	if j.cron != nil {
+		return j.cron.Next(from).Add(jitter(j.schedule.Jitter))
+	}
+	return from.Add(j.schedule.Every + jitter(j.schedule.Jitter))
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (s *Scheduler) execute(j *job) {
+	start := time.Now()
+	s.lock.Lock()
+	j.status.Running = true
+	j.status.LastRun = start
+	s.lock.Unlock()
+
+	items, err := s.run(j.source)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j.status.Running = false
+	j.status.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	j.status.LastItems = items
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+	}
+}
+
+func (s *Scheduler) find(name string) (*job, error) {
+	j, ok := s.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSource, name)
+	}
+	return j, nil
+}
+
+// Pause stops the scheduled runs of a source, a run in progress completes.
+func (s *Scheduler) Pause(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	j.status.Paused = true
+	return nil
+}
+
+func (s *Scheduler) Resume(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	j.status.Paused = false
+	return nil
+}
+
+// RunNow triggers a run of the source even when it is paused.
+func (s *Scheduler) RunNow(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	if !s.started {
+		return fmt.Errorf("scheduler is not started")
+	}
+	if j.status.Running {
+		return fmt.Errorf("%w: %s", ErrRunning, name)
+	}
+	select {
+	case j.wake <- struct{}{}:
+	default:
+		log.Printf("Run of %s already requested", name)
+	}
+	return nil
+}
+
+// Statuses returns the state of every source sorted by name.
+func (s *Scheduler) Statuses() []Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		status := j.status
+		if status.Paused {
+			status.NextRun = time.Time{}
+		}
+		out = append(out, status)
+	}
+	sort.Slice(out, func(i, k int) bool {
+		return out[i].Name < out[k].Name
+	})
+	return out
+}
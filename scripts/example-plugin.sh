@@ -0,0 +1,10 @@
+#!/bin/sh
+# Example pumago source plugin, declare it in ~/.config/puma/plugins.json:
+#   [{"name": "example", "command": "/path/to/example-plugin.sh", "origin": "unknown", "timeout": "1m"}]
+# stdin carries {"state": {...}}, stdout takes one JSON object per line.
+read -r input
+last=$(echo "$input" | sed -n 's/.*"last_run":"\([0-9]*\)".*/\1/p')
+now=$(date +%s)
+echo "example plugin, previous run: ${last:-never}" >&2
+echo "{\"content\": {\"id\": \"example-$now\", \"url\": \"https://example.com/$now\", \"title\": \"Example $now\", \"last_modified_millis\": ${now}000, \"content\": \"Hello from the example plugin\"}}"
+echo "{\"state\": {\"last_run\": \"$now\"}}"
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"log"
+	"net/http"
+	"pumago/content"
+	"pumago/llm"
+	"strings"
+	"time"
+)
+
+// minToolTokens bounds the output of a tool when the RAG budget is small.
+const minToolTokens = 500
+
+// stepLimitAnswer replaces the empty answer of a model still calling tools at AgentSteps.
+const stepLimitAnswer = "I couldn't find the answer within %d steps of searching. Try a more specific question."
+
+const agentInstructions = "You answer the user's questions from their own documents: browsing history, bookmarks, " +
+	"Drive files, email, chats, feeds, shell history and git commits. Use the tools to find what you need: search " +
+	"once for each part of a question with several parts, read a whole document when its snippet isn't enough and " +
+	"fetch a page when it may have changed since it was indexed. Stop calling tools as soon as you can answer, and " +
+	"say so when the documents don't tell. The tools number the documents they return, cite them with their number " +
+	"in brackets right after the statement, e.g. [1] or [1, 3]. Today is %s."
+
+// agent holds the documents the tools showed the model during one answer, the
+// model cites them by their position starting at 1.
+type agent struct {
+	ws         *WebServer
+	tokenizer  llm.Tokenizer
+	toolTokens int
+	documents  []content.Content
+	numbers    map[string]int
+}
+
+// cite returns the number of doc, registering it the first time a tool shows it.
+func (a *agent) cite(doc content.Content) int {
+	key := doc.Origin.String() + " " + doc.ID
+	if n, found := a.numbers[key]; found {
+		return n
+	}
+	a.documents = append(a.documents, doc)
+	a.numbers[key] = len(a.documents)
+	return len(a.documents)
+}
+
+// statusLine formats a status for the start of a streamed agent answer.
+func statusLine(status string) string {
+	return "_" + status + "_\n\n"
+}
+
+// trimStatus removes the status lines from the start of an agent answer.
+func trimStatus(answer string) string {
+	for strings.HasPrefix(answer, "_") {
+		line, rest, found := strings.Cut(answer, "_\n\n")
+		if !found || strings.Contains(line, "\n") || !strings.HasSuffix(line, "…") {
+			break
+		}
+		answer = rest
+	}
+	return answer
+}
+
+// agentStream writes the status lines and the answer of a streamed agent answer.
+type agentStream struct {
+	w       http.ResponseWriter
+	id      string
+	model   string
+	started bool
+}
+
+func (s *agentStream) write(content string, reason openai.FinishReason, sources []Source) {
+	delta := openai.ChatCompletionStreamChoiceDelta{Content: content}
+	if !s.started {
+		startStream(s.w, answerFromModel)
+		delta.Role = openai.ChatMessageRoleAssistant
+		s.started = true
+	}
+	chunk := openai.ChatCompletionStreamResponse{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   s.model,
+		Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: reason}},
+	}
+	if sources == nil {
+		writeStreamResponse(s.w, chunk)
+		return
+	}
+	writeStreamEvent(s.w, citedStreamResponse{ChatCompletionStreamResponse: chunk, Sources: sources})
+}
+
+// agentHandler lets the model call the tools for up to AgentSteps rounds before
+// it must answer. A streamed answer starts with a status line for each tool
+// call, the answer itself comes last with its Sources block. It stops once ctx,
+// the request's, is done.
+func (ws *WebServer) agentHandler(ctx context.Context, c conversation) Handler {
+	return func(w http.ResponseWriter, req openai.ChatCompletionRequest) {
+		route := ws.Chat.Resolve(req.Model)
+		a := &agent{
+			ws:         ws,
+			tokenizer:  llm.TokenizerFor(route.Model),
+			toolTokens: max(ws.ContextTokens/2, minToolTokens),
+			numbers:    make(map[string]int),
+		}
+		stream := &agentStream{w: w, id: "chatcmpl-" + uuid.New().String(), model: route.Model}
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+
+		call := req
+		call.Model = route.Model
+		call.Stream = false
+		call.StreamOptions = nil
+		call.Tools = agentTools
+		call.Messages = withSystemPrompt(req.Messages, fmt.Sprintf(agentInstructions, time.Now().Format(time.DateOnly)))
+		var usage openai.Usage
+		var response openai.ChatCompletionResponse
+		for step := 0; ; step++ {
+			if step >= ws.AgentSteps {
+				call.ToolChoice = "none"
+			}
+			var err error
+			response, err = route.Backend.CreateChatCompletion(ctx, call)
+			if ctx.Err() != nil {
+				log.Printf("Agent stopped after %d steps, the client is gone", step)
+				return
+			}
+			if err == nil && len(response.Choices) == 0 {
+				err = errors.New("no answer")
+			}
+			if err != nil {
+				if stream.started {
+					stream.write(fmt.Sprintf("Failed to get response from %s backend: %v", route.Name, err), openai.FinishReasonStop, nil)
+					w.Write([]byte("data: [DONE]\n\n"))
+				} else {
+					writeBackendError(w, route, err)
+				}
+				return
+			}
+			usage.PromptTokens += response.Usage.PromptTokens
+			usage.CompletionTokens += response.Usage.CompletionTokens
+			usage.TotalTokens += response.Usage.TotalTokens
+			message := response.Choices[0].Message
+			if len(message.ToolCalls) == 0 || step >= ws.AgentSteps {
+				break
+			}
+			call.Messages = append(call.Messages, message)
+			for _, toolCall := range message.ToolCalls {
+				if ctx.Err() != nil {
+					log.Printf("Agent stopped after %d steps, the client is gone", step)
+					return
+				}
+				log.Printf("Agent step %d: %s %s", step+1, toolCall.Function.Name, toolCall.Function.Arguments)
+				if req.Stream {
+					stream.write(statusLine(toolStatus(toolCall)), "", nil)
+				}
+				call.Messages = append(call.Messages, openai.ChatCompletionMessage{
+					Role:       openai.ChatMessageRoleTool,
+					Content:    a.runTool(ctx, toolCall),
+					ToolCallID: toolCall.ID,
+				})
+			}
+		}
+
+		text := response.Choices[0].Message.Content
+		if strings.TrimSpace(text) == "" {
+			text = fmt.Sprintf(stepLimitAnswer, ws.AgentSteps)
+		}
+		cite := newCitations(a.documents)
+		answer := cite.filter(text) + cite.flush() + cite.block()
+		log.Printf("Agent answered with %d documents, %d cited, in %d tokens", len(a.documents), len(cite.cited), usage.TotalTokens)
+		if req.Stream {
+			stream.write(answer, openai.FinishReasonStop, cite.sources())
+			if includeUsage {
+				writeStreamResponse(w, openai.ChatCompletionStreamResponse{
+					ID:      stream.id,
+					Object:  "chat.completion.chunk",
+					Created: time.Now().Unix(),
+					Model:   stream.model,
+					Choices: []openai.ChatCompletionStreamChoice{},
+					Usage:   &usage,
+				})
+			}
+			w.Write([]byte("data: [DONE]\n\n"))
+		} else {
+			response.Choices = response.Choices[:1]
+			response.Choices[0].Message = openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: answer}
+			response.Choices[0].FinishReason = openai.FinishReasonStop
+			response.Usage = usage
+			writeCompletion(w, answerFromModel, citedCompletion{ChatCompletionResponse: response, Sources: cite.sources()})
+		}
+		ws.saveConversation(c, answer)
+	}
+}
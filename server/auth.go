@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type Scope string
+
+const (
+	// ScopeRead allows searching and watching the index and reading the server's status.
+	ScopeRead Scope = "read"
+	// ScopeChat allows chat completions, including RAG answers.
+	ScopeChat Scope = "chat"
+	// ScopeAdmin allows everything, including controlling sources and retries.
+	ScopeAdmin Scope = "admin"
+)
+
+// APIKey is a named bearer token and what it may do.
+type APIKey struct {
+	Name   string
+	Key    string
+	Scopes []Scope
+}
+
+func (k APIKey) allows(scope Scope) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyContext struct{}
+
+// apiError is the body of OpenAI's error responses, clients already know how to show it.
+type apiError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+func writeError(w http.ResponseWriter, status int, errorType string, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{"error": {Message: message, Type: errorType, Code: code}})
+}
+
+// writeStatusError writes an OpenAI style error with the type and code matching status.
+func writeStatusError(w http.ResponseWriter, status int, message string) {
+	errorType := "invalid_request_error"
+	if status >= 500 {
+		errorType = "server_error"
+	}
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	writeError(w, status, errorType, code, message)
+}
+
+// lookupKey finds the key of the request's "Authorization: Bearer" header.
+func (ws *WebServer) lookupKey(r *http.Request) (APIKey, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !found || token == "" {
+		return APIKey{}, false
+	}
+	for _, key := range ws.Keys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key.Key)) == 1 {
+			return key, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// authenticated rejects requests without a valid key and otherwise passes the
+// key on in the request context, handlers check its scopes with authorize.
+func (ws *WebServer) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := ws.lookupKey(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key",
+				"Incorrect API key provided. Pass one of the configured keys as 'Authorization: Bearer <key>'.")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	}
+}
+
+// authorize writes a 403 error and returns false when the request's key lacks scope.
+func authorize(w http.ResponseWriter, r *http.Request, scope Scope) bool {
+	key, _ := r.Context().Value(apiKeyContext{}).(APIKey)
+	if key.allows(scope) {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "invalid_request_error", "insufficient_scope",
+		"API key '"+key.Name+"' lacks the '"+string(scope)+"' scope.")
+	return false
+}
+
+// require authenticates the request and checks its key has scope.
+func (ws *WebServer) require(scope Scope, next http.HandlerFunc) http.HandlerFunc {
+	return ws.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if authorize(w, r, scope) {
+			next(w, r)
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"pumago/content"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// citationPattern matches "[2]" and "[1, 3]" citation markers.
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// maxCitationLength bounds how much text an unclosed "[" holds back while streaming.
+const maxCitationLength = 16
+
+// Source is a document cited by a RAG answer, Index is its [n] in the answer.
+type Source struct {
+	Index        int    `json:"index"`
+	Title        string `json:"title"`
+	URL          string `json:"url"`
+	Origin       string `json:"origin"`
+	ID           string `json:"id"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// citedCompletion is a chat completion with the sources of its answer.
+type citedCompletion struct {
+	openai.ChatCompletionResponse
+	Sources []Source `json:"sources"`
+}
+
+// citedStreamResponse is the stream chunk carrying the Sources block.
+type citedStreamResponse struct {
+	openai.ChatCompletionStreamResponse
+	Sources []Source `json:"sources"`
+}
+
+func documentDate(doc content.Content) string {
+	if doc.LastModifiedMillis <= 0 {
+		return ""
+	}
+	return time.UnixMilli(doc.LastModifiedMillis).Format(time.DateOnly)
+}
+
+// citations tracks the documents an answer cites and drops markers of documents
+// that weren't in the prompt. Brackets in code, like x[0], are left alone.
+type citations struct {
+	documents []content.Content
+	cited     []int
+	seen      map[int]bool
+	// pending is streamed text held back because it may be the start of a marker
+	// or of a run of backticks.
+	pending string
+	// fence is set inside a fenced code block, inline is the length of the
+	// backtick run opening the current code span.
+	fence  bool
+	inline int
+	// previous is the last character emitted, a marker must follow a space or
+	// punctuation.
+	previous rune
+}
+
+func newCitations(documents []content.Content) *citations {
+	return &citations{documents: documents, seen: make(map[int]bool)}
+}
+
+// filter returns the text to emit, it may hold back the end of text until the
+// next call or flush.
+func (c *citations) filter(text string) string {
+	return c.scan(c.pending+text, false)
+}
+
+// flush returns the text held back at the end of the answer.
+func (c *citations) flush() string {
+	return c.scan(c.pending, true)
+}
+
+// markerBoundary tells whether a marker may follow r, unlike the index in a[2].
+func markerBoundary(r rune) bool {
+	return r == 0 || unicode.IsSpace(r) || (unicode.IsPunct(r) || unicode.IsSymbol(r)) && r != '_'
+}
+
+// scan replaces the markers of text outside of code. Unless final, a trailing
+// "[digits" or run of backticks is kept in pending for the next chunk.
+func (c *citations) scan(text string, final bool) string {
+	c.pending = ""
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '`':
+			end := i
+			for end < len(text) && text[end] == '`' {
+				end++
+			}
+			if end == len(text) && !final {
+				c.pending = text[i:]
+				return out.String()
+			}
+			run := end - i
+			switch {
+			case c.fence:
+				c.fence = run < 3
+			case c.inline > 0:
+				if run == c.inline {
+					c.inline = 0
+				}
+			case run >= 3:
+				c.fence = true
+			default:
+				c.inline = run
+			}
+			out.WriteString(text[i:end])
+			c.previous = '`'
+			i = end
+		case text[i] == '[' && !c.fence && c.inline == 0 && markerBoundary(c.previous):
+			closing := strings.IndexByte(text[i:], ']')
+			if closing < 0 {
+				if !final && len(text)-i < maxCitationLength && strings.Trim(text[i+1:], "0123456789, ") == "" {
+					c.pending = text[i:]
+					return out.String()
+				}
+			} else if marker := text[i : i+closing+1]; citationPattern.FindString(marker) == marker {
+				if replaced := c.replace(marker); replaced != "" {
+					out.WriteString(replaced)
+					c.previous = ']'
+				}
+				i += closing + 1
+				continue
+			}
+			out.WriteByte('[')
+			c.previous = '['
+			i++
+		default:
+			r, size := utf8.DecodeRuneInString(text[i:])
+			// code spans end with their paragraph
+			if r == '\n' && c.previous == '\n' {
+				c.inline = 0
+			}
+			out.WriteString(text[i : i+size])
+			c.previous = r
+			i += size
+		}
+	}
+	return out.String()
+}
+
+// replace keeps the numbers of a marker that match a document, and records them.
+func (c *citations) replace(marker string) string {
+	valid := make([]string, 0)
+	for _, number := range strings.Split(marker[1:len(marker)-1], ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil || n < 1 || n > len(c.documents) {
+			continue
+		}
+		valid = append(valid, strconv.Itoa(n))
+		if !c.seen[n] {
+			c.seen[n] = true
+			c.cited = append(c.cited, n)
+		}
+	}
+	if len(valid) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(valid, ", ") + "]"
+}
+
+// sources lists the cited documents in the order they were first cited.
+func (c *citations) sources() []Source {
+	sources := make([]Source, 0, len(c.cited))
+	for _, n := range c.cited {
+		doc := c.documents[n-1]
+		sources = append(sources, Source{
+			Index:        n,
+			Title:        doc.Title,
+			URL:          doc.URL,
+			Origin:       doc.Origin.String(),
+			ID:           doc.ID,
+			LastModified: documentDate(doc),
+		})
+	}
+	return sources
+}
+
+// block is the Sources block appended to the answer, empty without citations.
+func (c *citations) block() string {
+	sources := c.sources()
+	if len(sources) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("\n\n**Sources:**\n")
+	for _, source := range sources {
+		title := source.Title
+		if title == "" {
+			title = source.URL
+		}
+		fmt.Fprintf(&out, "\n- [%d] [%s](%s)", source.Index, title, source.URL)
+		if source.LastModified != "" {
+			fmt.Fprintf(&out, ", %s", source.LastModified)
+		}
+	}
+	out.WriteString("\n")
+	return out.String()
+}
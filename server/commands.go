@@ -13,10 +13,15 @@ const (
 	Raw  Command = iota
 	Watch
 	Query
+	Sources
+	// Rag is the default mode, "/rag template:name" picks its prompt template.
+	Rag
+	// Agent lets the model search with tools before answering.
+	Agent
 )
 
 func (c Command) String() string {
-	return [...]string{"none", "raw", "watch", "query"}[c]
+	return [...]string{"none", "raw", "watch", "query", "sources", "rag", "agent"}[c]
 }
 func ParseCommand(input string) (Command, error) {
 	input = strings.ToLower(input)
@@ -27,6 +32,12 @@ func ParseCommand(input string) (Command, error) {
 		return Watch, nil
 	case "query":
 		return Query, nil
+	case "sources":
+		return Sources, nil
+	case "rag":
+		return Rag, nil
+	case "agent":
+		return Agent, nil
 	default:
 		return -1, fmt.Errorf("invalid command: %s", input)
 	}
@@ -46,3 +57,19 @@ func command(input string) (Command, string) {
 
 	return parseCommand, matches[2]
 }
+
+// commandScope is the scope a key needs to run cmd with the given arguments.
+func commandScope(cmd Command, args string) Scope {
+	switch cmd {
+	case Query, Watch:
+		return ScopeRead
+	case Sources:
+		// listing is harmless, pausing or running sources is not
+		if strings.TrimSpace(args) != "" {
+			return ScopeAdmin
+		}
+		return ScopeRead
+	default:
+		return ScopeChat
+	}
+}
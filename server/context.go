@@ -0,0 +1,144 @@
+package server
+
+import (
+	"pumago/content"
+	"pumago/index"
+	"pumago/llm"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// minTrimTokens is the smallest remainder of the budget worth filling with the
+// start of a chunk that doesn't fit.
+const minTrimTokens = 64
+
+// defaultAnswerTokens is kept free in the context window for the answer when the
+// request doesn't set max_tokens.
+const defaultAnswerTokens = 1024
+
+// contextChunk is a retrieved chunk, part is its position in its document.
+type contextChunk struct {
+	result   index.Result
+	docID    string
+	part     int
+	shingles map[string]bool
+}
+
+// contextDocument gathers the chunks of a document that made it into the context.
+type contextDocument struct {
+	chunks []contextChunk
+}
+
+// splitChunkID returns the document ID and position of a chunk ID like "id/3".
+func splitChunkID(id string) (string, int) {
+	if cut := strings.LastIndex(id, "/"); cut >= 0 {
+		if part, err := strconv.Atoi(id[cut+1:]); err == nil {
+			return id[:cut], part
+		}
+	}
+	return id, 0
+}
+
+// wordShingles are the word triples of text, compared to spot passages repeated
+// across documents, e.g. the same page from two browsers.
+func wordShingles(text string) map[string]bool {
+	words := strings.Fields(strings.ToLower(text))
+	shingles := make(map[string]bool)
+	if len(words) < 3 {
+		shingles[strings.Join(words, " ")] = true
+		return shingles
+	}
+	for i := 0; i+3 <= len(words); i++ {
+		shingles[strings.Join(words[i:i+3], " ")] = true
+	}
+	return shingles
+}
+
+// overlap is the Jaccard similarity of two shingle sets.
+func overlap(a map[string]bool, b map[string]bool) float32 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for shingle := range a {
+		if b[shingle] {
+			shared++
+		}
+	}
+	return float32(shared) / float32(len(a)+len(b)-shared)
+}
+
+// buildContext fills budget tokens with results in score order. A chunk repeating
+// a better one is skipped, the first that doesn't fit is trimmed, and the chunks
+// are grouped by document with neighbouring ones joined back together. The
+// documents are in the order of their best chunk.
+func buildContext(results []index.Result, budget int, tokenizer llm.Tokenizer, duplicate float32) []content.Content {
+	documents := make(map[string]*contextDocument)
+	order := make([]string, 0)
+	accepted := make([]contextChunk, 0)
+	seen := make(map[string]bool)
+	used := 0
+	for _, result := range results {
+		if seen[result.Content.ID] {
+			continue
+		}
+		seen[result.Content.ID] = true
+		docID, part := splitChunkID(result.Content.ID)
+		chunk := contextChunk{result: result, docID: docID, part: part, shingles: wordShingles(result.Content.Content)}
+		repeated := false
+		for _, other := range accepted {
+			if overlap(chunk.shingles, other.shingles) >= duplicate {
+				repeated = true
+				break
+			}
+		}
+		if repeated {
+			continue
+		}
+		cost := tokenizer.Count(result.Content.Content)
+		header := 0
+		if documents[docID] == nil {
+			empty := promptDocument(len(order)+1, result.Content)
+			empty.Content = ""
+			header = tokenizer.Count(formatDocument(empty))
+		}
+		if used+header+cost > budget {
+			remaining := budget - used - header
+			if remaining < minTrimTokens {
+				continue
+			}
+			chunk.result.Content.Content = tokenizer.Truncate(result.Content.Content, remaining)
+			cost = tokenizer.Count(chunk.result.Content.Content)
+		}
+		if documents[docID] == nil {
+			documents[docID] = &contextDocument{}
+			order = append(order, docID)
+		}
+		documents[docID].chunks = append(documents[docID].chunks, chunk)
+		accepted = append(accepted, chunk)
+		used += header + cost
+		if used >= budget-minTrimTokens {
+			break
+		}
+	}
+
+	out := make([]content.Content, 0, len(order))
+	for _, docID := range order {
+		chunks := documents[docID].chunks
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].part < chunks[j].part })
+		doc := chunks[0].result.Content
+		doc.ID = docID
+		var text strings.Builder
+		for i, chunk := range chunks {
+			// chunks are consecutive slices of the document, only gaps need a marker
+			if i > 0 && chunk.part != chunks[i-1].part+1 {
+				text.WriteString("\n[...]\n")
+			}
+			text.WriteString(chunk.result.Content.Content)
+		}
+		doc.Content = text.String()
+		out = append(out, doc)
+	}
+	return out
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"log"
+	"net/http"
+	"pumago/content"
+	"strings"
+	"time"
+)
+
+// ConversationPrefix starts the ID of every conversation turn stored as CHAT content,
+// it tells them apart from imported chat exports.
+const ConversationPrefix = "conversation:"
+
+// conversation is the user side of a chat request, captured before RAG rewrites it.
+type conversation struct {
+	id       string
+	store    bool
+	messages []openai.ChatCompletionMessage
+	// opening is the messages up to the first user message as the client sent
+	// them, with the first answer they identify the conversation when the
+	// client doesn't.
+	opening string
+	// history keys the retrievals of this turn and previous those of the turn
+	// before, see historyKey.
+	history  string
+	previous string
+}
+
+// newConversation keys a request by the X-Conversation-Id header, the
+// "conversation_id" metadata or, failing both, a hash of its first messages and
+// the first answer (clients resend the whole history so it stays stable across
+// turns, and chats opening with the same question still differ). It must see
+// the messages as sent, before a command is cut off the last one.
+// Storing is skipped with "X-Puma-Store: false" or metadata "puma_store": "false".
+func newConversation(r *http.Request, req openai.ChatCompletionRequest) conversation {
+	id := r.Header.Get("X-Conversation-Id")
+	if id == "" {
+		id = req.Metadata["conversation_id"]
+	}
+	store := !strings.EqualFold(r.Header.Get("X-Puma-Store"), "false") &&
+		!strings.EqualFold(req.Metadata["puma_store"], "false")
+	messages := make([]openai.ChatCompletionMessage, len(req.Messages))
+	copy(messages, req.Messages)
+	c := conversation{id: id, store: store, messages: messages}
+
+	last := len(messages) - 1
+	var opening strings.Builder
+	for i, message := range messages {
+		opening.WriteString(message.Role + ":" + message.Content + "\n")
+		if message.Role != openai.ChatMessageRoleUser {
+			continue
+		}
+		c.opening = opening.String()
+		for j := i + 1; c.id == "" && j < last; j++ {
+			if messages[j].Role == openai.ChatMessageRoleAssistant {
+				c.id = c.conversationID(messages[j].Content)
+			}
+		}
+		break
+	}
+
+	key, _ := r.Context().Value(apiKeyContext{}).(APIKey)
+	c.history = historyKey(key.Name, messages[:max(last, 0)])
+	for i := last - 1; i >= 0; i-- {
+		if messages[i].Role == openai.ChatMessageRoleUser {
+			c.previous = historyKey(key.Name, messages[:i])
+			break
+		}
+	}
+	return c
+}
+
+// conversationID hashes the opening messages and the first answer, without the
+// status lines an agent answer starts with.
+func (c conversation) conversationID(answer string) string {
+	hash := sha1.New()
+	hash.Write([]byte(c.opening + "assistant:" + trimStatus(answer)))
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// historyKey hashes the messages before a question for the key named keyName,
+// so that only the same conversation of the same key shares cached retrievals.
+func historyKey(keyName string, messages []openai.ChatCompletionMessage) string {
+	hash := sha1.New()
+	hash.Write([]byte(keyName + "\n"))
+	for _, message := range messages {
+		hash.Write([]byte(message.Role + ":" + message.Content + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// turn returns the latest exchange as CHAT content, one Fragment per user turn.
+func (c conversation) turn(answer string) content.Content {
+	turn := 0
+	question := ""
+	title := ""
+	for _, message := range c.messages {
+		if message.Role == openai.ChatMessageRoleUser {
+			turn++
+			question = message.Content
+			if title == "" {
+				title = message.Content
+			}
+		}
+	}
+	id := c.id
+	if id == "" {
+		// the first turn, the answer completes the ID
+		id = c.conversationID(answer)
+	}
+	if len(title) > 80 {
+		title = title[:80] + "..."
+	}
+	return content.Content{
+		ID:                 fmt.Sprintf("%s%s/%d", ConversationPrefix, id, turn),
+		URL:                "puma://conversation/" + id,
+		Title:              title,
+		LastModifiedMillis: time.Now().UnixMilli(),
+		Fragment:           turn,
+		Origin:             content.CHAT,
+		Content:            fmt.Sprintf("User: %s\n\nAssistant: %s", question, answer),
+		Metadata: map[string]string{
+			"Conversation": id,
+			"Turn":         fmt.Sprintf("%d", turn),
+		},
+	}
+}
+
+// saveConversation queues the finished exchange for the database and the index.
+func (ws *WebServer) saveConversation(c conversation, answer string) {
+	if !c.store || ws.Ingest == nil || strings.TrimSpace(answer) == "" {
+		return
+	}
+	turn := c.turn(answer)
+	// a full queue must not hold up the answer
+	select {
+	case ws.Ingest <- turn:
+	default:
+		log.Printf("Ingest queue full, dropping conversation turn %s", turn.ID)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"pumago/content"
+	"time"
+)
+
+type failureResponse struct {
+	ID        string     `json:"id"`
+	Origin    string     `json:"origin"`
+	Title     string     `json:"title"`
+	URL       string     `json:"url"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"last_error"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+}
+
+// failuresHandler serves GET /v1/failures?status=failed|dead.
+func (ws *WebServer) failuresHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := failedStatus(r.URL.Query().Get("status"))
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	failures, err := ws.Pipeline.Failures(status)
+	if err != nil {
+		writeStatusError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := make([]failureResponse, 0, len(failures))
+	for _, failure := range failures {
+		response := failureResponse{
+			ID:        failure.ID,
+			Origin:    failure.Origin.String(),
+			Title:     failure.Title,
+			URL:       failure.URL,
+			Status:    failure.Status.String(),
+			Attempts:  failure.Attempts,
+			LastError: failure.LastError,
+		}
+		if failure.RetryAtMillis > 0 {
+			retryAt := time.UnixMilli(failure.RetryAtMillis)
+			response.RetryAt = &retryAt
+		}
+		out = append(out, response)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"failures": out})
+}
+
+// retryHandler serves POST /v1/failures/retry. {"origin": "chrome", "id": "..."}
+// retries one content, {"status": "dead"} every content with that status.
+func (ws *WebServer) retryHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Origin string `json:"origin"`
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeStatusError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.ID != "" {
+		origin, err := content.ParseOrigin(req.Origin)
+		if err != nil {
+			writeStatusError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := ws.Pipeline.RetryNow(origin, req.ID); err != nil {
+			writeStatusError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{"queued": 1})
+		return
+	}
+	status, err := failedStatus(req.Status)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	queued, err := ws.Pipeline.RetryAll(status)
+	if err != nil {
+		writeStatusError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"queued": queued})
+}
+
+// failedStatus parses the status of a failures request, FAILED when empty.
+func failedStatus(input string) (content.Status, error) {
+	if input == "" {
+		return content.FAILED, nil
+	}
+	status, err := content.ParseStatus(input)
+	if err == nil && status != content.FAILED && status != content.DEAD {
+		err = fmt.Errorf("status must be failed or dead, got %s", input)
+	}
+	return status, err
+}
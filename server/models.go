@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// virtualModels select a command mode from a frontend's model picker, a slash
+// command in the message still takes precedence.
+var virtualModels = map[string]Command{
+	"puma-rag":    None,
+	"puma-raw":    Raw,
+	"puma-search": Query,
+	"puma-agent":  Agent,
+}
+
+var virtualModelNames = []string{"puma-rag", "puma-raw", "puma-search", "puma-agent"}
+
+// modelCommand returns the command mode of a virtual model, its prompt template
+// and the model to ask: "puma-rag@sonnet" answers with the sonnet model,
+// "puma-rag" with the default one and "puma-research" uses the research template.
+func (ws *WebServer) modelCommand(model string) (Command, string, string, bool) {
+	virtual, target, _ := strings.Cut(model, "@")
+	if cmd, ok := virtualModels[virtual]; ok {
+		return cmd, "", target, true
+	}
+	if name, found := strings.CutPrefix(virtual, "puma-"); found && ws.prompts().Has(name) {
+		return None, name, target, true
+	}
+	return None, "", model, false
+}
+
+type modelResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+var startedAt = time.Now().Unix()
+
+// modelsHandler serves GET /v1/models, the virtual models, one per prompt template,
+// and the configured models of the chat backends.
+func (ws *WebServer) modelsHandler(w http.ResponseWriter, r *http.Request) {
+	models := make([]modelResponse, 0, len(virtualModelNames))
+	for _, name := range virtualModelNames {
+		models = append(models, modelResponse{ID: name, Object: "model", Created: startedAt, OwnedBy: "puma"})
+	}
+	for _, name := range ws.prompts().Names() {
+		if _, taken := virtualModels["puma-"+name]; !taken && name != DefaultPrompt {
+			models = append(models, modelResponse{ID: "puma-" + name, Object: "model", Created: startedAt, OwnedBy: "puma"})
+		}
+	}
+	if ws.Chat != nil {
+		for _, name := range ws.Chat.Models() {
+			models = append(models, modelResponse{ID: name, Object: "model", Created: startedAt, OwnedBy: ws.Chat.Resolve(name).Name})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": models})
+}
+
+type embeddingData struct {
+	Object    string `json:"object"`
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"`
+}
+
+// embeddingsHandler serves POST /v1/embeddings with the index's embedding provider,
+// the requested model is ignored so the vectors always match the index.
+func (ws *WebServer) embeddingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input          json.RawMessage `json:"input"`
+		EncodingFormat string          `json:"encoding_format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeStatusError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	var inputs []string
+	var single string
+	if err := json.Unmarshal(req.Input, &single); err == nil {
+		inputs = []string{single}
+	} else if err := json.Unmarshal(req.Input, &inputs); err != nil {
+		writeStatusError(w, http.StatusBadRequest, "input must be a string or an array of strings")
+		return
+	}
+	if len(inputs) == 0 {
+		writeStatusError(w, http.StatusBadRequest, "input must not be empty")
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		writeStatusError(w, http.StatusBadRequest, fmt.Sprintf("unsupported encoding_format %q", req.EncodingFormat))
+		return
+	}
+	embeddings, err := ws.Index.EmbedBatch(inputs)
+	if err != nil {
+		writeStatusError(w, http.StatusBadGateway, fmt.Sprintf("Embedding failed: %v", err))
+		return
+	}
+	data := make([]embeddingData, 0, len(embeddings))
+	tokens := 0
+	for i, embedding := range embeddings {
+		var encoded any = embedding
+		if req.EncodingFormat == "base64" {
+			encoded = encodeEmbedding(embedding)
+		}
+		data = append(data, embeddingData{Object: "embedding", Index: i, Embedding: encoded})
+		tokens += estimateTokens(inputs[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"object": "list",
+		"data":   data,
+		"model":  ws.Index.EmbeddingModel(),
+		"usage":  map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	})
+}
+
+// encodeEmbedding is OpenAI's base64 format, little endian float32s.
+func encodeEmbedding(embedding []float32) string {
+	var buf bytes.Buffer
+	for _, value := range embedding {
+		binary.Write(&buf, binary.LittleEndian, math.Float32bits(value))
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
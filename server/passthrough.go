@@ -2,35 +2,129 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/sashabaranov/go-openai"
 	"io"
 	"net/http"
+	"pumago/content"
+	"pumago/llm"
+	"strings"
 )
 
-func (ws *WebServer) chatDefaultStreamHandler(w http.ResponseWriter, req openai.ChatCompletionRequest) {
+// chatDefaultStreamHandler relays the model's stream and returns the assembled answer.
+// With cite, invalid citations are dropped and the chunk finishing the answer
+// carries the Sources block.
+func (ws *WebServer) chatDefaultStreamHandler(w http.ResponseWriter, req openai.ChatCompletionRequest, cite *citations) string {
 	ctx := context.Background()
-	stream, err := ws.OpenAIClient.CreateChatCompletionStream(ctx, req)
+	route := ws.Chat.Resolve(req.Model)
+	req.Model = route.Model
+	stream, err := route.Backend.CreateChatCompletionStream(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get response from OpenAI: %v", err), http.StatusInternalServerError)
-		return
+		writeBackendError(w, route, err)
+		return ""
 	}
 	defer stream.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.WriteHeader(http.StatusOK)
+	startStream(w, answerFromModel)
+	var answer strings.Builder
+	var last openai.ChatCompletionStreamResponse
 	for {
 		response, err := stream.Recv()
 		if err != nil {
 			if err == io.EOF {
+				if cite != nil {
+					// the stream ended without a finish reason
+					text := cite.flush() + cite.block()
+					answer.WriteString(text)
+					last.Choices = []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: text}}}
+					writeStreamEvent(w, citedStreamResponse{ChatCompletionStreamResponse: last, Sources: cite.sources()})
+				}
 				w.Write([]byte("data: [DONE]\n\n"))
 				break
 			}
 			http.Error(w, fmt.Sprintf("Failed to receive stream response: %v", err), http.StatusInternalServerError)
-			return
+			return ""
 		}
+		last = response
+		if len(response.Choices) == 0 {
+			writeStreamResponse(w, response)
+			continue
+		}
+		choice := &response.Choices[0]
+		if cite != nil {
+			choice.Delta.Content = cite.filter(choice.Delta.Content)
+			if choice.FinishReason != "" && choice.FinishReason != openai.FinishReasonNull {
+				choice.Delta.Content += cite.flush() + cite.block()
+				answer.WriteString(choice.Delta.Content)
+				writeStreamEvent(w, citedStreamResponse{ChatCompletionStreamResponse: response, Sources: cite.sources()})
+				cite = nil
+				continue
+			}
+		}
+		answer.WriteString(choice.Delta.Content)
 		writeStreamResponse(w, response)
 	}
+	return answer.String()
+}
+
+// chatDefaultHandler relays the model's complete answer, usage included, and returns it.
+// With cite, the answer ends with its Sources block and the response lists them.
+func (ws *WebServer) chatDefaultHandler(w http.ResponseWriter, req openai.ChatCompletionRequest, cite *citations) string {
+	route := ws.Chat.Resolve(req.Model)
+	req.Model = route.Model
+	response, err := route.Backend.CreateChatCompletion(context.Background(), req)
+	if err != nil {
+		writeBackendError(w, route, err)
+		return ""
+	}
+	if len(response.Choices) == 0 {
+		writeCompletion(w, answerFromModel, response)
+		return ""
+	}
+	message := &response.Choices[0].Message
+	if cite == nil {
+		writeCompletion(w, answerFromModel, response)
+		return message.Content
+	}
+	message.Content = cite.filter(message.Content) + cite.flush() + cite.block()
+	writeCompletion(w, answerFromModel, citedCompletion{ChatCompletionResponse: response, Sources: cite.sources()})
+	return message.Content
+}
+
+// writeBackendError passes on the client errors of a backend, e.g. an unknown
+// model, anything else is a 502.
+func writeBackendError(w http.ResponseWriter, route llm.Route, err error) {
+	status := http.StatusBadGateway
+	var apiError *openai.APIError
+	if errors.As(err, &apiError) && apiError.HTTPStatusCode >= 400 && apiError.HTTPStatusCode < 500 {
+		status = apiError.HTTPStatusCode
+	}
+	writeStatusError(w, status, fmt.Sprintf("Failed to get response from %s backend for model %q: %v", route.Name, route.Model, err))
+}
+
+// chatHandler returns the model's answer and records the exchange as CHAT content.
+func (ws *WebServer) chatHandler(c conversation) Handler {
+	return ws.answerHandler(c, nil)
+}
+
+// ragHandler is chatHandler for a prompt made of documents, the answer cites them.
+func (ws *WebServer) ragHandler(c conversation, documents []content.Content) Handler {
+	return ws.answerHandler(c, documents)
+}
+
+func (ws *WebServer) answerHandler(c conversation, documents []content.Content) Handler {
+	return func(w http.ResponseWriter, req openai.ChatCompletionRequest) {
+		var cite *citations
+		if documents != nil {
+			cite = newCitations(documents)
+		}
+		var answer string
+		if req.Stream {
+			answer = ws.chatDefaultStreamHandler(w, req, cite)
+		} else {
+			answer = ws.chatDefaultHandler(w, req, cite)
+		}
+		ws.saveConversation(c, answer)
+	}
 }
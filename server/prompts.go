@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"pumago/content"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultPrompt names the template used when neither the config, the model nor
+// the command picks one.
+const DefaultPrompt = "default"
+
+// PromptData is what a prompt template is executed with.
+type PromptData struct {
+	// Query is the user's last message, SearchQuery what was searched for it,
+	// the standalone rewrite of a follow-up question.
+	Query       string
+	SearchQuery string
+	Documents   []PromptDocument
+	// Date is today as 2006-01-02.
+	Date  string
+	Now   time.Time
+	Model string
+	// Metadata is the metadata of the request.
+	Metadata map[string]string
+}
+
+// PromptDocument is a retrieved document, N is the number it is cited with.
+type PromptDocument struct {
+	N        int
+	ID       string
+	Title    string
+	URL      string
+	Origin   string
+	Date     string
+	Content  string
+	Metadata map[string]string
+}
+
+func promptDocument(n int, doc content.Content) PromptDocument {
+	return PromptDocument{
+		N:        n,
+		ID:       doc.ID,
+		Title:    doc.Title,
+		URL:      doc.URL,
+		Origin:   doc.Origin.String(),
+		Date:     documentDate(doc),
+		Content:  doc.Content,
+		Metadata: doc.Metadata,
+	}
+}
+
+// formatDocument is the standard block of a document in a prompt.
+func formatDocument(doc PromptDocument) string {
+	out := fmt.Sprintf("\n<DOC id=\"%d\">\nTitle: %s\nURL: %s\n", doc.N, doc.Title, doc.URL)
+	if doc.Date != "" {
+		out += fmt.Sprintf("Date: %s\n", doc.Date)
+	}
+	return out + doc.Content + "\n</DOC>\n"
+}
+
+// promptPartials can be used by every template: {{template "cite"}} asks for
+// citations the way the answer's Sources block expects them and
+// {{template "documents" .}} lists the documents.
+const promptPartials = `{{define "cite"}}When you use a document, cite it with its number in brackets right after the statement, e.g. [1] or [1, 3]. Only cite the documents listed here.{{end}}` +
+	`{{define "documents"}}{{range .Documents}}{{document .}}{{end}}{{end}}`
+
+// builtinPrompts are the templates shipped with pumago, the config can replace them.
+var builtinPrompts = map[string]string{
+	DefaultPrompt: `Answer the user's question using the numbered documents below when they are relevant. {{template "cite"}} Today is {{.Date}}.
+{{template "documents" .}}`,
+
+	"research": `You are a research assistant. Answer the user's question by synthesizing the numbered documents below: ` +
+		`compare what they say, point out when they disagree or may be outdated given their dates, and say what they don't cover ` +
+		`instead of guessing. {{template "cite"}} Today is {{.Date}}.
+{{template "documents" .}}`,
+
+	"code": `You help the user recall code and technical details they have seen before: commands, snippets, repositories ` +
+		`and commits. Quote code exactly as it appears in the numbered documents below, in fenced blocks, and prefer the ` +
+		`most recent ones when they differ. Name the repository or page it came from. {{template "cite"}}
+{{template "documents" .}}`,
+
+	"meeting": `You help the user prepare for a meeting. From the numbered documents below, summarize the background, ` +
+		`the decisions already made, the open questions and action items and who is involved, as short bullet lists. ` +
+		`{{template "cite"}} Today is {{.Date}}.
+{{template "documents" .}}`,
+}
+
+// Prompts are the named system prompt templates of RAG answers.
+type Prompts struct {
+	templates map[string]*template.Template
+	// Default is used when the request doesn't pick a template.
+	Default string
+}
+
+// NewPrompts parses the builtin templates and texts, which add to or replace them.
+func NewPrompts(texts map[string]string, defaultName string) (*Prompts, error) {
+	base, err := template.New("").Funcs(template.FuncMap{"document": formatDocument}).Parse(promptPartials)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]string, len(builtinPrompts)+len(texts))
+	for name, text := range builtinPrompts {
+		all[name] = text
+	}
+	for name, text := range texts {
+		all[name] = text
+	}
+	prompts := &Prompts{templates: make(map[string]*template.Template), Default: defaultName}
+	for name, text := range all {
+		t, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.New(name).Option("missingkey=zero").Parse(text); err != nil {
+			return nil, fmt.Errorf("prompt template %s: %w", name, err)
+		}
+		prompts.templates[name] = t
+	}
+	if prompts.Default == "" {
+		prompts.Default = DefaultPrompt
+	}
+	if !prompts.Has(prompts.Default) {
+		return nil, fmt.Errorf("unknown default prompt template %q", prompts.Default)
+	}
+	return prompts, nil
+}
+
+func (p *Prompts) Has(name string) bool {
+	_, found := p.templates[name]
+	return found
+}
+
+// Names lists the templates in alphabetical order.
+func (p *Prompts) Names() []string {
+	names := make([]string, 0, len(p.templates))
+	for name := range p.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// render executes the named template, the default one when name is empty.
+func (p *Prompts) render(name string, data PromptData) (string, error) {
+	if name == "" {
+		name = p.Default
+	}
+	t, found := p.templates[name]
+	if !found {
+		return "", fmt.Errorf("unknown prompt template %q", name)
+	}
+	var out strings.Builder
+	if err := t.ExecuteTemplate(&out, name, data); err != nil {
+		return "", fmt.Errorf("prompt template %s: %w", name, err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// withSystemPrompt inserts prompt as a system message after the client's own
+// leading system messages, the user's messages are left as they are.
+func withSystemPrompt(messages []openai.ChatCompletionMessage, prompt string) []openai.ChatCompletionMessage {
+	at := 0
+	for at < len(messages) && (messages[at].Role == openai.ChatMessageRoleSystem || messages[at].Role == "developer") {
+		at++
+	}
+	out := make([]openai.ChatCompletionMessage, 0, len(messages)+1)
+	out = append(out, messages[:at]...)
+	out = append(out, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: prompt})
+	return append(out, messages[at:]...)
+}
+
+// templateArgument cuts a leading "template:name" off the arguments of /rag.
+func templateArgument(input string) (string, string) {
+	trimmed := strings.TrimSpace(input)
+	first, rest, _ := strings.Cut(trimmed, " ")
+	name, found := strings.CutPrefix(first, "template:")
+	if !found {
+		return "", input
+	}
+	return name, strings.TrimSpace(rest)
+}
@@ -2,81 +2,156 @@ package server
 
 import (
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/sashabaranov/go-openai"
 	"log"
 	"net/http"
 	"pumago/content"
+	"pumago/index"
+	"pumago/llm"
+	"strings"
+	"sync"
+	"time"
 )
 
 func (ws *WebServer) queryIndex(query string) ([]content.Content, error) {
-	return ws.Index.Query(query, 10)
+	query, filter := index.ParseFilter(query)
+	limit := ws.QueryLimit
+	if limit < 1 {
+		limit = 10
+	}
+	results, err := ws.Index.Search(query, limit, filter)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]content.Content, 0, len(results))
+	for _, res := range results {
+		documents = append(documents, res.Content)
+	}
+	return documents, nil
+}
+
+// contextBudget is how many tokens of documents fit in the prompt of req: the
+// configured budget, less when the conversation, the instructions and the
+// answer nearly fill the model's context window.
+func (ws *WebServer) contextBudget(req openai.ChatCompletionRequest, window int, instructions int, tokenizer llm.Tokenizer) int {
+	budget := ws.ContextTokens
+	if window <= 0 {
+		return budget
+	}
+	reserved := defaultAnswerTokens
+	if req.MaxCompletionTokens > 0 {
+		reserved = req.MaxCompletionTokens
+	} else if req.MaxTokens > 0 {
+		reserved = req.MaxTokens
+	}
+	reserved += instructions
+	for _, message := range req.Messages {
+		reserved += tokenizer.Count(message.Content)
+	}
+	return max(0, min(budget, window-reserved))
 }
 
-func (ws *WebServer) RagPrompt(prompt string) (string, error) {
-	// Query the index
-	documents, err := ws.queryIndex(prompt)
+var builtinPromptSet = sync.OnceValues(func() (*Prompts, error) { return NewPrompts(nil, DefaultPrompt) })
+
+// prompts returns the configured templates, the builtin ones without a config.
+func (ws *WebServer) prompts() *Prompts {
+	if ws.Prompts != nil {
+		return ws.Prompts
+	}
+	prompts, err := builtinPromptSet()
 	if err != nil {
-		return "", err
+		log.Fatalf("Invalid builtin prompt templates: %v", err)
 	}
-	return formatPrompt(prompt, documents), nil
+	return prompts
 }
-func formatPrompt(userQuery string, documents []content.Content) string {
-	prompt := "Here are some documents that might be useful:\n"
-	for _, doc := range documents {
-		prompt += fmt.Sprintf("<DOC> %s\n", doc.Content)
+
+// RagPrompt returns the messages of req with a system message made of the named
+// prompt template, the default one when empty, and the documents matching input,
+// the last message, that fit the budget. It also returns the documents, which the
+// answer cites by their position starting at 1, and the tokens of the messages.
+// Follow-up questions are searched as a standalone query, along with the
+// documents of the previous turn of the conversation.
+func (ws *WebServer) RagPrompt(req openai.ChatCompletionRequest, c conversation, input string, templateName string) (messages []openai.ChatCompletionMessage, documents []content.Content, tokens int, err error) {
+	route := llm.Route{}
+	if ws.Chat != nil {
+		route = ws.Chat.Resolve(req.Model)
+	}
+	tokenizer := llm.TokenizerFor(route.Model)
+	query, filter := index.ParseFilter(input)
+	query, mode := ws.standaloneQuery(req, c, query)
+	log.Printf("Searching %q (%s)", query, mode)
+	data := PromptData{
+		Query:       input,
+		SearchQuery: query,
+		Date:        time.Now().Format(time.DateOnly),
+		Now:         time.Now(),
+		Model:       route.Model,
+		Metadata:    req.Metadata,
+	}
+	instructions, err := ws.prompts().render(templateName, data)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	key := fmt.Sprintf("%v %s", filter, query)
+	results, cached, previous := ws.Retrievals.results(c.history, c.previous, key)
+	if !cached {
+		limit := ws.ContextCandidates
+		if limit < 1 {
+			limit = 10
+		}
+		results, err = ws.Index.Search(query, limit, filter)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		ws.Retrievals.putResults(c.history, key, results)
+	}
+	candidates := results
+	if len(history(req.Messages)) > 0 {
+		// buildContext skips the chunks found again
+		candidates = append(append(make([]index.Result, 0, len(results)+len(previous)), results...), previous...)
+	}
+	budget := ws.contextBudget(req, route.ContextWindow, tokenizer.Count(instructions), tokenizer)
+	documents = buildContext(candidates, budget, tokenizer, ws.DuplicateOverlap)
+
+	for i, doc := range documents {
+		data.Documents = append(data.Documents, promptDocument(i+1, doc))
+	}
+	system, err := ws.prompts().render(templateName, data)
+	if err != nil {
+		return nil, nil, 0, err
 	}
-	prompt += fmt.Sprintf("\n\n<Prompt>%s", userQuery)
-	return prompt
+	messages = withSystemPrompt(req.Messages, system)
+	for _, message := range messages {
+		tokens += tokenizer.Count(message.Content)
+	}
+	log.Printf("RAG context for %s with template %q: %d documents from %d results (cached: %t) in %d of %d tokens, prompt of %d tokens:\n%s",
+		route.Model, templateName, len(documents), len(candidates), cached,
+		tokenizer.Count(system)-tokenizer.Count(instructions), budget, tokens, system)
+	return messages, documents, tokens, nil
 }
+
+// handleQueryCommand answers with the matching documents straight from the vector store.
 func (ws *WebServer) handleQueryCommand(w http.ResponseWriter, req openai.ChatCompletionRequest) {
 
 	docs, err := ws.queryIndex(req.Messages[len(req.Messages)-1].Content)
 	if err != nil {
+		writeStatusError(w, http.StatusInternalServerError, fmt.Sprintf("Query failed: %v", err))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.WriteHeader(http.StatusOK)
-	for i, doc := range docs {
-		//log.Printf("Sending doc %s", doc.Markdown())
-		response := openai.ChatCompletionStreamResponse{
-			Choices: []openai.ChatCompletionStreamChoice{
-				{
-					Index: i,
-					Delta: openai.ChatCompletionStreamChoiceDelta{
-						Role:    openai.ChatMessageRoleAssistant,
-						Content: doc.Markdown(),
-					},
-				},
-			},
-			Model: "vectors",
-			ID:    "stream-response-id:" + doc.ID,
-		}
-		writeStreamResponse(w, response)
-		if i == len(docs)-1 {
-			w.Write([]byte("data: [DONE]\n\n"))
+	if !req.Stream {
+		parts := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			parts = append(parts, doc.Markdown())
 		}
+		writeCompletion(w, answerFromVectors, textCompletion("vectors", strings.Join(parts, "\n\n"), req.Messages))
+		return
 	}
-}
-
-func (ws *WebServer) handleWatchCommand(w http.ResponseWriter, req openai.ChatCompletionRequest) {
-	key := uuid.New().String()
-	channel := make(chan content.Content)
-	ws.Outputs[key] = channel
-	defer func() {
-		delete(ws.Outputs, key)
-	}()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.WriteHeader(http.StatusOK)
-	i := 0
-	for doc := range channel {
-		log.Printf("Sending doc %s", doc.ID)
+	startStream(w, answerFromVectors)
+	for i, doc := range docs {
+		//log.Printf("Sending doc %s", doc.Markdown())
 		response := openai.ChatCompletionStreamResponse{
 			Choices: []openai.ChatCompletionStreamChoice{
 				{
@@ -91,7 +166,6 @@ func (ws *WebServer) handleWatchCommand(w http.ResponseWriter, req openai.ChatCo
 			ID:    "stream-response-id:" + doc.ID,
 		}
 		writeStreamResponse(w, response)
-		i++
 	}
-
+	w.Write([]byte("data: [DONE]\n\n"))
 }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AnswerSourceHeader tells clients whether the answer was generated by the model or
+// is made of documents returned straight from the vector store.
+const AnswerSourceHeader = "X-Puma-Answer-Source"
+
+// ContextTokensHeader is the size in tokens of a RAG prompt, documents included.
+const ContextTokensHeader = "X-Puma-Context-Tokens"
+
+const (
+	answerFromModel   = "model"
+	answerFromVectors = "vectors"
+	answerFromServer  = "server"
+)
+
+// estimateTokens approximates the token count of text for answers that don't come
+// from a model, at about four characters per token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// textCompletion wraps text generated by pumago itself in a chat completion.
+func textCompletion(model string, text string, messages []openai.ChatCompletionMessage) openai.ChatCompletionResponse {
+	prompt := 0
+	for _, message := range messages {
+		prompt += estimateTokens(message.Content)
+	}
+	completion := estimateTokens(text)
+	return openai.ChatCompletionResponse{
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openai.ChatCompletionChoice{
+			{
+				Index: 0,
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: text,
+				},
+				FinishReason: openai.FinishReasonStop,
+			},
+		},
+		Usage: openai.Usage{
+			PromptTokens:     prompt,
+			CompletionTokens: completion,
+			TotalTokens:      prompt + completion,
+		},
+	}
+}
+
+// writeCompletion writes a chat completion, or a type embedding one to add fields.
+func writeCompletion(w http.ResponseWriter, source string, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(AnswerSourceHeader, source)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
+
+func startStream(w http.ResponseWriter, source string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set(AnswerSourceHeader, source)
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeTextResponse answers a chat request with a single message generated by pumago.
+func writeTextResponse(w http.ResponseWriter, req openai.ChatCompletionRequest, text string) {
+	if !req.Stream {
+		writeCompletion(w, answerFromServer, textCompletion("puma", text, req.Messages))
+		return
+	}
+	startStream(w, answerFromServer)
+	writeStreamResponse(w, openai.ChatCompletionStreamResponse{
+		Choices: []openai.ChatCompletionStreamChoice{
+			{
+				Delta: openai.ChatCompletionStreamChoiceDelta{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: text,
+				},
+			},
+		},
+		Model: "puma",
+		ID:    "stream-response-id:text",
+	})
+	w.Write([]byte("data: [DONE]\n\n"))
+}
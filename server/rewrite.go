@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"log"
+	"pumago/index"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query rewriting modes, see WebServer.Rewrite.
+const (
+	RewriteLLM       = "llm"
+	RewriteHeuristic = "heuristic"
+	RewriteOff       = "off"
+)
+
+const (
+	// rewriteTurns is how many previous messages are shown to the rewriting model.
+	rewriteTurns = 6
+	// rewriteMessageLength bounds each of them, answers can be long.
+	rewriteMessageLength = 1000
+	rewriteTimeout       = 15 * time.Second
+)
+
+const rewriteInstructions = "You rewrite the last question of a conversation as a standalone search query " +
+	"for a document index. Resolve references like \"it\" or \"the second one\" using the conversation " +
+	"and keep the names, dates and terms that matter. Answer with the query only."
+
+// history returns the user and assistant messages before the last one.
+func history(messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	out := make([]openai.ChatCompletionMessage, 0)
+	if len(messages) == 0 {
+		return out
+	}
+	for _, message := range messages[:len(messages)-1] {
+		if message.Role == openai.ChatMessageRoleUser || message.Role == openai.ChatMessageRoleAssistant {
+			out = append(out, message)
+		}
+	}
+	return out
+}
+
+func shorten(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	return strings.ToValidUTF8(text[:length], "") + "..."
+}
+
+// standaloneQuery rewrites query, the last message of req without its filters,
+// so that it can be searched without the conversation. The mode says how it was
+// rewritten: llm, heuristic, cached or unchanged.
+func (ws *WebServer) standaloneQuery(req openai.ChatCompletionRequest, c conversation, query string) (string, string) {
+	turns := history(req.Messages)
+	if len(turns) == 0 || ws.Rewrite == RewriteOff || strings.TrimSpace(query) == "" {
+		return query, "unchanged"
+	}
+	// "and the other one?" means something else at every turn, the history
+	// key tells them apart
+	if rewritten, found := ws.Retrievals.rewrite(c.history, query); found {
+		return rewritten, "cached"
+	}
+	rewritten, mode := "", RewriteHeuristic
+	if ws.Rewrite == RewriteLLM && ws.Chat != nil {
+		var err error
+		rewritten, err = ws.rewriteWithModel(req, turns, query)
+		if err != nil {
+			log.Printf("Failed to rewrite %q with the model, using the previous turn: %v", query, err)
+		} else {
+			mode = RewriteLLM
+		}
+	}
+	if rewritten == "" {
+		rewritten, mode = rewriteHeuristic(turns, query), RewriteHeuristic
+	}
+	ws.Retrievals.putRewrite(c.history, query, rewritten)
+	return rewritten, mode
+}
+
+func (ws *WebServer) rewriteWithModel(req openai.ChatCompletionRequest, turns []openai.ChatCompletionMessage, query string) (string, error) {
+	if len(turns) > rewriteTurns {
+		turns = turns[len(turns)-rewriteTurns:]
+	}
+	var conversation strings.Builder
+	for _, turn := range turns {
+		role := "User"
+		if turn.Role == openai.ChatMessageRoleAssistant {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&conversation, "%s: %s\n\n", role, shorten(turn.Content, rewriteMessageLength))
+	}
+	model := ws.RewriteModel
+	if model == "" {
+		model = req.Model
+	}
+	route := ws.Chat.Resolve(model)
+	ctx, cancel := context.WithTimeout(context.Background(), rewriteTimeout)
+	defer cancel()
+	response, err := route.Backend.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:     route.Model,
+		MaxTokens: 100,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: rewriteInstructions},
+			{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf("Conversation:\n%s\nLast question: %s", conversation.String(), query)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("no answer from %s", route.Name)
+	}
+	return strings.Trim(strings.TrimSpace(response.Choices[0].Message.Content), "\"'"), nil
+}
+
+// rewriteHeuristic puts the previous question and the start of its answer in
+// front of the query, enough for the embedding to stay on the same topic.
+func rewriteHeuristic(turns []openai.ChatCompletionMessage, query string) string {
+	parts := make([]string, 0, 3)
+	for i := len(turns) - 1; i >= 0; i-- {
+		if turns[i].Role == openai.ChatMessageRoleUser {
+			parts = append(parts, shorten(turns[i].Content, 300))
+			if i+1 < len(turns) {
+				parts = append(parts, shorten(turns[i+1].Content, 300))
+			}
+			break
+		}
+	}
+	return strings.Join(append(parts, query), "\n")
+}
+
+// Retrievals caches the rewritten queries and the documents retrieved at each
+// turn of a conversation, keyed by the history before the turn's question (see
+// historyKey). A follow-up also gets the documents of the previous turn.
+type Retrievals struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*retrievals
+}
+
+type retrievals struct {
+	used     time.Time
+	rewrites map[string]string
+	results  map[string][]index.Result
+	last     []index.Result
+}
+
+// NewRetrievals keeps size turns for ttl after they were last used.
+func NewRetrievals(size int, ttl time.Duration) *Retrievals {
+	return &Retrievals{ttl: ttl, size: size, entries: make(map[string]*retrievals)}
+}
+
+// get returns the entry of a history, nil when it expired or is unknown.
+func (r *Retrievals) get(history string) *retrievals {
+	entry, found := r.entries[history]
+	if !found || time.Since(entry.used) > r.ttl {
+		delete(r.entries, history)
+		return nil
+	}
+	entry.used = time.Now()
+	return entry
+}
+
+// entry returns the entry of a history, creating it and evicting the least
+// recently used one if needed.
+func (r *Retrievals) entry(history string) *retrievals {
+	if entry := r.get(history); entry != nil {
+		return entry
+	}
+	if len(r.entries) >= r.size {
+		oldest := ""
+		for key, entry := range r.entries {
+			if oldest == "" || entry.used.Before(r.entries[oldest].used) {
+				oldest = key
+			}
+		}
+		delete(r.entries, oldest)
+	}
+	entry := &retrievals{used: time.Now(), rewrites: make(map[string]string), results: make(map[string][]index.Result)}
+	r.entries[history] = entry
+	return entry
+}
+
+func (r *Retrievals) rewrite(history string, query string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := r.get(history)
+	if entry == nil {
+		return "", false
+	}
+	rewritten, found := entry.rewrites[query]
+	return rewritten, found
+}
+
+func (r *Retrievals) putRewrite(history string, query string, rewritten string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entry(history).rewrites[query] = rewritten
+}
+
+// results returns the cached results of query and those of the previous turn,
+// keyed by the history before its question.
+func (r *Retrievals) results(history string, previousHistory string, query string) (cached []index.Result, found bool, previous []index.Result) {
+	if r == nil {
+		return nil, false, nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry := r.get(history); entry != nil {
+		cached, found = entry.results[query]
+	}
+	if previousHistory != "" {
+		if entry := r.get(previousHistory); entry != nil {
+			previous = entry.last
+		}
+	}
+	return cached, found, previous
+}
+
+func (r *Retrievals) putResults(history string, query string, results []index.Result) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := r.entry(history)
+	entry.results[query] = results
+	entry.last = results
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"pumago/scheduler"
+	"strings"
+	"time"
+)
+
+// sourceAction applies pause, resume or run to the named source.
+func (ws *WebServer) sourceAction(action string, name string) error {
+	if ws.Scheduler == nil {
+		return fmt.Errorf("no scheduler")
+	}
+	switch action {
+	case "pause":
+		return ws.Scheduler.Pause(name)
+	case "resume":
+		return ws.Scheduler.Resume(name)
+	case "run":
+		return ws.Scheduler.RunNow(name)
+	default:
+		return fmt.Errorf("unknown action %q, use pause, resume or run", action)
+	}
+}
+
+// sourcesHandler serves GET /v1/sources, the status of every scheduled source.
+func (ws *WebServer) sourcesHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]scheduler.Status, 0)
+	if ws.Scheduler != nil {
+		statuses = ws.Scheduler.Statuses()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"sources": statuses})
+}
+
+// sourceActionHandler serves POST /v1/sources/{name}/{action}.
+func (ws *WebServer) sourceActionHandler(w http.ResponseWriter, r *http.Request) {
+	err := ws.sourceAction(r.PathValue("action"), r.PathValue("name"))
+	switch {
+	case errors.Is(err, scheduler.ErrUnknownSource):
+		writeStatusError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, scheduler.ErrRunning):
+		writeStatusError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeStatusError(w, http.StatusBadRequest, err.Error())
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// handleSourcesCommand implements "/sources" to list the sources and
+// "/sources pause|resume|run <name>" to control one.
+func (ws *WebServer) handleSourcesCommand(w http.ResponseWriter, req openai.ChatCompletionRequest) {
+	args := strings.Fields(req.Messages[len(req.Messages)-1].Content)
+	text := ""
+	if len(args) == 2 {
+		if err := ws.sourceAction(args[0], args[1]); err != nil {
+			text = fmt.Sprintf("Failed to %s %s: %v", args[0], args[1], err)
+		} else {
+			text = fmt.Sprintf("Done: %s %s", args[0], args[1])
+		}
+	} else if len(args) == 0 && ws.Scheduler != nil {
+		text = formatStatuses(ws.Scheduler.Statuses())
+	} else {
+		text = "Usage: /sources [pause|resume|run <name>]"
+	}
+	writeTextResponse(w, req, text)
+}
+
+func formatStatuses(statuses []scheduler.Status) string {
+	var out strings.Builder
+	out.WriteString("| Source | Schedule | State | Last run | Duration | Items | Error |\n")
+	out.WriteString("|---|---|---|---|---|---|---|\n")
+	for _, s := range statuses {
+		state := "next " + s.NextRun.Format(time.DateTime)
+		if s.Paused {
+			state = "paused"
+		}
+		if s.Running {
+			state = "running"
+		}
+		lastRun := "never"
+		if !s.LastRun.IsZero() {
+			lastRun = s.LastRun.Format(time.DateTime)
+		}
+		fmt.Fprintf(&out, "| %s | %s | %s | %s | %s | %d | %s |\n",
+			s.Name, s.Schedule, state, lastRun, s.LastDuration, s.LastItems, s.LastError)
+	}
+	return out.String()
+}
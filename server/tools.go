@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"pumago/content"
+	"pumago/content/sources"
+	"pumago/index"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxFetchSize bounds the pages fetched by the fetch_url tool.
+const maxFetchSize = 4 << 20
+
+// Documents looks up stored content for the agent's tools.
+type Documents interface {
+	Get(origin content.Origin, id string) (content.Content, error)
+	Recent(limit int, origins ...content.Origin) ([]content.Content, error)
+}
+
+// agentTools are the functions offered to the model in agent mode.
+var agentTools = []openai.Tool{
+	{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name:        "search_index",
+		Description: "Semantic search of the user's indexed documents: browsing history, bookmarks, Drive, email, chats, feeds, shell history and git commits. Returns numbered documents with a snippet.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{
+			"query":{"type":"string","description":"what to search for, a standalone description of the information needed"},
+			"origins":{"type":"array","items":{"type":"string","enum":["chrome","safari","google_drive","audio","chat","email","feed","bookmark","shell","git"]},"description":"only search these sources"},
+			"bookmarked":{"type":"boolean","description":"only search bookmarked pages"},
+			"limit":{"type":"integer","description":"number of results, 5 by default, at most 20"}},
+			"required":["query"]}`),
+	}},
+	{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name:        "get_document",
+		Description: "Fetches the full text of a document returned by search_index or list_recent.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{
+			"id":{"type":"string","description":"the id of the document"},
+			"origin":{"type":"string","description":"the origin of the document"}},
+			"required":["id","origin"]}`),
+	}},
+	{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name:        "list_recent",
+		Description: "Lists the most recently modified documents, e.g. the latest emails or visited pages.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{
+			"origins":{"type":"array","items":{"type":"string","enum":["chrome","safari","google_drive","audio","chat","email","feed","bookmark","shell","git"]},"description":"only list these sources"},
+			"limit":{"type":"integer","description":"number of documents, 10 by default, at most 50"}}}`),
+	}},
+	{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+		Name:        "fetch_url",
+		Description: "Fetches the current text of a web page or document by URL, for information that isn't indexed or may have changed.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{
+			"url":{"type":"string","description":"an http or https URL"}},
+			"required":["url"]}`),
+	}},
+}
+
+type toolArguments struct {
+	Query      string   `json:"query"`
+	Origins    []string `json:"origins"`
+	Bookmarked bool     `json:"bookmarked"`
+	Limit      int      `json:"limit"`
+	ID         string   `json:"id"`
+	Origin     string   `json:"origin"`
+	URL        string   `json:"url"`
+}
+
+func parseOrigins(names []string) ([]content.Origin, error) {
+	origins := make([]content.Origin, 0, len(names))
+	for _, name := range names {
+		origin, err := content.ParseOrigin(name)
+		if err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+func clamp(value int, fallback int, most int) int {
+	if value < 1 {
+		return fallback
+	}
+	return min(value, most)
+}
+
+// toolStatus is the progress line streamed while a tool runs.
+func toolStatus(call openai.ToolCall) string {
+	var args toolArguments
+	json.Unmarshal([]byte(call.Function.Arguments), &args)
+	switch call.Function.Name {
+	case "search_index":
+		return fmt.Sprintf("Searching for \"%s\"…", args.Query)
+	case "get_document":
+		return fmt.Sprintf("Reading %s…", args.ID)
+	case "list_recent":
+		if len(args.Origins) == 0 {
+			return "Listing recent documents…"
+		}
+		return fmt.Sprintf("Listing recent %s documents…", strings.Join(args.Origins, ", "))
+	case "fetch_url":
+		return fmt.Sprintf("Fetching %s…", args.URL)
+	default:
+		return fmt.Sprintf("Running %s…", call.Function.Name)
+	}
+}
+
+// runTool executes a tool call, failures are reported to the model so it can
+// try something else.
+func (a *agent) runTool(ctx context.Context, call openai.ToolCall) string {
+	var args toolArguments
+	if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+		return fmt.Sprintf("Error: invalid arguments: %v", err)
+	}
+	var result string
+	var err error
+	switch call.Function.Name {
+	case "search_index":
+		result, err = a.searchIndex(args)
+	case "get_document":
+		result, err = a.getDocument(args)
+	case "list_recent":
+		result, err = a.listRecent(args)
+	case "fetch_url":
+		result, err = a.fetchURL(ctx, args)
+	default:
+		err = fmt.Errorf("unknown tool %s", call.Function.Name)
+	}
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return a.tokenizer.Truncate(result, a.toolTokens)
+}
+
+// describe lists a document for the model with the number it cites it with.
+func (a *agent) describe(out *strings.Builder, doc content.Content, text string) {
+	fmt.Fprintf(out, "[%d] %s\n", a.cite(doc), doc.Title)
+	// fetched pages aren't stored, get_document can't read them
+	if doc.Origin != content.UNKNOWN {
+		fmt.Fprintf(out, "id: %s, origin: %s, ", doc.ID, strings.ToLower(doc.Origin.String()))
+	}
+	fmt.Fprintf(out, "url: %s", doc.URL)
+	if date := documentDate(doc); date != "" {
+		fmt.Fprintf(out, ", date: %s", date)
+	}
+	fmt.Fprintf(out, "\n%s\n\n", text)
+}
+
+func (a *agent) searchIndex(args toolArguments) (string, error) {
+	if strings.TrimSpace(args.Query) == "" {
+		return "", errors.New("query is required")
+	}
+	origins, err := parseOrigins(args.Origins)
+	if err != nil {
+		return "", err
+	}
+	results, err := a.ws.Index.Search(args.Query, clamp(args.Limit, 5, 20), index.Filter{Origins: origins, Bookmarked: args.Bookmarked})
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "No matching documents.", nil
+	}
+	var out strings.Builder
+	for _, result := range results {
+		doc := result.Content
+		doc.ID, _ = splitChunkID(doc.ID)
+		a.describe(&out, doc, shorten(doc.Content, 700))
+	}
+	return out.String(), nil
+}
+
+func (a *agent) getDocument(args toolArguments) (string, error) {
+	if a.ws.Documents == nil {
+		return "", errors.New("documents can't be read")
+	}
+	origin, err := content.ParseOrigin(args.Origin)
+	if err != nil {
+		return "", err
+	}
+	doc, err := a.ws.Documents.Get(origin, args.ID)
+	if err != nil {
+		return "", fmt.Errorf("no document %s from %s", args.ID, args.Origin)
+	}
+	var out strings.Builder
+	a.describe(&out, doc, doc.Content)
+	return out.String(), nil
+}
+
+func (a *agent) listRecent(args toolArguments) (string, error) {
+	if a.ws.Documents == nil {
+		return "", errors.New("documents can't be listed")
+	}
+	origins, err := parseOrigins(args.Origins)
+	if err != nil {
+		return "", err
+	}
+	docs, err := a.ws.Documents.Recent(clamp(args.Limit, 10, 50), origins...)
+	if err != nil {
+		return "", err
+	}
+	if len(docs) == 0 {
+		return "No documents.", nil
+	}
+	var out strings.Builder
+	for _, doc := range docs {
+		a.describe(&out, doc, shorten(doc.Content, 300))
+	}
+	return out.String(), nil
+}
+
+func (a *agent) fetchURL(ctx context.Context, args toolArguments) (string, error) {
+	if !a.ws.FetchURLs {
+		return "", errors.New("fetching URLs is disabled")
+	}
+	parsed, err := url.Parse(args.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", fmt.Errorf("invalid URL %q, only http and https are fetched", args.URL)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := a.ws.fetchClient().Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s", parsed.Host, response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxFetchSize))
+	if err != nil {
+		return "", err
+	}
+	text, err := sources.ExtractFileContent(parsed.Path, response.Header.Get("Content-Type"), data)
+	if err != nil {
+		return "", err
+	}
+	doc := content.Content{ID: parsed.String(), URL: parsed.String(), Title: parsed.Host + parsed.Path, LastModifiedMillis: time.Now().UnixMilli()}
+	var out strings.Builder
+	a.describe(&out, doc, content.Content{Content: text}.Shrink().Content)
+	return out.String(), nil
+}
+
+// fetchClient refuses to connect to this machine and private networks unless
+// FetchPrivate is set, the model must not reach what the user's browser can't.
+func (ws *WebServer) fetchClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !ws.FetchPrivate {
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				return fmt.Errorf("refusing to fetch from %s", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &http.Client{Transport: transport, Timeout: ws.FetchTimeout}
+}
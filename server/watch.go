@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"pumago/content"
+	"pumago/events"
+	"pumago/index"
+	"strconv"
+	"strings"
+)
+
+// defaultWatchThreshold is the similarity a content needs to match a "similar:" query.
+const defaultWatchThreshold = 0.4
+
+// watch is a parsed /watch request, e.g.
+//
+//	/watch origin:google_drive domain:*.google.com postmortem similar:"my rag project" threshold:0.5
+//
+// Plain words and "quoted phrases" must all appear in the content.
+type watch struct {
+	filter    index.Filter
+	domains   []string
+	keywords  []string
+	similar   string
+	threshold float32
+	buffer    int
+	policy    events.Policy
+}
+
+// watchTerms splits the input on spaces, except inside double quotes which are removed.
+func watchTerms(input string) []string {
+	terms := make([]string, 0)
+	var term strings.Builder
+	quoted := false
+	for _, r := range input {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms
+}
+
+func (ws *WebServer) parseWatch(input string) (watch, error) {
+	w := watch{threshold: defaultWatchThreshold, buffer: ws.WatchBuffer, policy: ws.WatchPolicy}
+	filterTerms := make([]string, 0)
+	for _, term := range watchTerms(input) {
+		key, value, found := strings.Cut(term, ":")
+		if !found {
+			w.keywords = append(w.keywords, strings.ToLower(term))
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "origin", "is":
+			filterTerms = append(filterTerms, term)
+		case "domain":
+			for _, glob := range strings.Split(strings.ToLower(value), ",") {
+				if _, err := path.Match(glob, ""); err != nil {
+					return w, fmt.Errorf("invalid domain %q: %v", glob, err)
+				}
+				w.domains = append(w.domains, glob)
+			}
+		case "similar":
+			w.similar = value
+		case "threshold":
+			threshold, err := strconv.ParseFloat(value, 32)
+			if err != nil {
+				return w, fmt.Errorf("invalid threshold %q", value)
+			}
+			w.threshold = float32(threshold)
+		case "buffer":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 {
+				return w, fmt.Errorf("invalid buffer %q", value)
+			}
+			w.buffer = size
+		case "policy":
+			policy, err := events.ParsePolicy(value)
+			if err != nil {
+				return w, err
+			}
+			w.policy = policy
+		default:
+			// "http://..." and the like are keywords too
+			w.keywords = append(w.keywords, strings.ToLower(term))
+		}
+	}
+	_, w.filter = index.ParseFilter(strings.Join(filterTerms, " "))
+	return w, nil
+}
+
+// matcher builds the bus filter, the score is the similarity to the "similar:"
+// query or 1 without one.
+func (ws *WebServer) matcher(w watch) (events.Filter, error) {
+	var embedding []float32
+	if w.similar != "" {
+		var err error
+		embedding, err = ws.Index.Embed(w.similar)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed %q: %v", w.similar, err)
+		}
+	}
+	return func(data content.Content) (float32, bool) {
+		if !w.filter.Match(data) || !matchDomain(w.domains, data.URL) {
+			return 0, false
+		}
+		if len(w.keywords) > 0 {
+			text := strings.ToLower(data.Title + "\n" + data.URL + "\n" + data.Content)
+			for _, keyword := range w.keywords {
+				if !strings.Contains(text, keyword) {
+					return 0, false
+				}
+			}
+		}
+		if embedding == nil {
+			return 1, true
+		}
+		similarity, found := ws.Index.Similarity(embedding, data)
+		return similarity, found && similarity >= w.threshold
+	}, nil
+}
+
+func matchDomain(globs []string, rawURL string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// watchHandler streams newly indexed content matching the terms of the message
+// along with its score, "policy:drop_oldest" and "buffer:N" tune the subscription.
+// It ends when the client disconnects or is dropped as a slow consumer.
+func (ws *WebServer) watchHandler(ctx context.Context) Handler {
+	return func(w http.ResponseWriter, req openai.ChatCompletionRequest) {
+		parsed, err := ws.parseWatch(req.Messages[len(req.Messages)-1].Content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := ws.matcher(parsed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		subscription := ws.Events.Subscribe(parsed.buffer, parsed.policy, filter)
+		defer ws.Events.Unsubscribe(subscription)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		i := 0
+		for {
+			select {
+			case <-ctx.Done():
+				log.Printf("Watcher %s disconnected", subscription.ID)
+				return
+			case <-subscription.Done():
+				log.Printf("Watcher %s dropped after %d missed contents", subscription.ID, subscription.Dropped())
+				return
+			case event := <-subscription.Events():
+				doc := event.Content
+				log.Printf("Sending doc %s with score %.3f", doc.ID, event.Score)
+				response := openai.ChatCompletionStreamResponse{
+					Choices: []openai.ChatCompletionStreamChoice{
+						{
+							Index: i,
+							Delta: openai.ChatCompletionStreamChoiceDelta{
+								Role:    openai.ChatMessageRoleAssistant,
+								Content: fmt.Sprintf("Score: %.3f\n\n%s", event.Score, doc.Markdown()),
+							},
+						},
+					},
+					Model: "vectors",
+					ID:    "stream-response-id:" + doc.ID,
+				}
+				writeStreamResponse(w, response)
+				i++
+			}
+		}
+	}
+}
@@ -7,23 +7,67 @@ import (
 	"github.com/sashabaranov/go-openai"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
 	"pumago/content"
+	"pumago/events"
 	"pumago/index"
+	"pumago/ingest"
+	"pumago/llm"
+	"pumago/scheduler"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type WebServer struct {
-	Port         int
-	OpenAIClient *openai.Client
-	MyApiKey     string
-	Index        index.Index
-	Outputs      map[string]chan content.Content
+	Host string
+	Port int
+	// Chat routes chat requests to a backend by their model.
+	Chat *llm.Router
+	// Keys are the bearer tokens accepted by every endpoint.
+	Keys  []APIKey
+	Index index.Index
+	// Events publishes newly indexed content to the /watch streams.
+	Events *events.Bus
+	// WatchBuffer and WatchPolicy are the defaults of /watch subscriptions.
+	WatchBuffer int
+	WatchPolicy events.Policy
+	// Ingest receives conversations to persist as CHAT content, nil disables it.
+	Ingest     chan<- content.Content
+	QueryLimit int
+	Scheduler  *scheduler.Scheduler
+	Pipeline   *ingest.Pipeline
+	// ContextTokens is the budget of documents in a RAG prompt, filled from the
+	// best ContextCandidates chunks, DuplicateOverlap is the word overlap
+	// above which a chunk repeats a better one.
+	ContextTokens     int
+	ContextCandidates int
+	DuplicateOverlap  float32
+	// Rewrite turns follow-up questions into standalone queries: llm asks
+	// RewriteModel (the request's model when empty), heuristic prepends the
+	// previous turn and off searches the last message as is.
+	Rewrite      string
+	RewriteModel string
+	// Retrievals caches the rewrites and documents of conversations, nil disables it.
+	Retrievals *Retrievals
+	// Prompts are the system prompt templates of RAG answers, nil uses the builtin ones.
+	Prompts *Prompts
+	// Documents are read by the agent's tools, which get AgentSteps rounds of
+	// tool calls. FetchURLs lets the agent fetch pages, FetchPrivate also from
+	// this machine and the local network, within FetchTimeout.
+	Documents    Documents
+	AgentSteps   int
+	FetchURLs    bool
+	FetchPrivate bool
+	FetchTimeout time.Duration
 }
 type Handler func(w http.ResponseWriter, req openai.ChatCompletionRequest)
 
 func writeStreamResponse(w http.ResponseWriter, response openai.ChatCompletionStreamResponse) {
+	writeStreamEvent(w, response)
+}
+
+// writeStreamEvent writes any chunk, e.g. one extending the OpenAI format.
+func writeStreamEvent(w http.ResponseWriter, response any) {
 	marshal, err := json.Marshal(response)
 
 	if err != nil {
@@ -42,69 +86,120 @@ func (ws *WebServer) chatCompletionsHandler(w http.ResponseWriter, r *http.Reque
 	var req openai.ChatCompletionRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeStatusError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 	log.Printf("Request %+v", req)
-	if !req.Stream {
-		http.Error(w, "Only Streaming Supported", http.StatusBadRequest)
+	mode, templateName, model, virtual := ws.modelCommand(req.Model)
+	req.Model = model
+	if len(req.Messages) == 0 {
+		writeStatusError(w, http.StatusBadRequest, "messages must not be empty")
 		return
 	}
 	input := req.Messages[len(req.Messages)-1].Content
 
 	cmd, input := command(input)
+	if cmd == None && virtual {
+		cmd = mode
+	}
+	if cmd == Rag {
+		var name string
+		if name, input = templateArgument(input); name != "" {
+			if !ws.prompts().Has(name) {
+				writeStatusError(w, http.StatusBadRequest, fmt.Sprintf("unknown prompt template %q, use one of %s",
+					name, strings.Join(ws.prompts().Names(), ", ")))
+				return
+			}
+			templateName = name
+		}
+	}
 	log.Printf("parse command '%s', '%s'", cmd.String(), input)
+	if !authorize(w, r, commandScope(cmd, input)) {
+		return
+	}
+	conversation := newConversation(r, req)
 	req.Messages[len(req.Messages)-1].Content = input
-	handler := ws.chatDefaultStreamHandler
+	conversation.messages[len(req.Messages)-1].Content = input
+	handler := ws.chatHandler(conversation)
 
 	switch cmd {
 	case Watch:
-		handler = ws.handleWatchCommand
+		if !req.Stream {
+			writeStatusError(w, http.StatusBadRequest, "/watch only works with stream: true")
+			return
+		}
+		handler = ws.watchHandler(r.Context())
 	case Query:
 		handler = ws.handleQueryCommand
+	case Sources:
+		handler = ws.handleSourcesCommand
 	case Raw:
-		handler = ws.chatDefaultStreamHandler
+		handler = ws.chatHandler(conversation)
+	case Agent:
+		handler = ws.agentHandler(r.Context(), conversation)
 	default:
-		prompt, err := ws.RagPrompt(input)
+		messages, documents, tokens, err := ws.RagPrompt(req, conversation, input, templateName)
 		if err != nil {
 			estr := fmt.Sprintf("Rag Failure %+v", err)
-			http.Error(w, estr, http.StatusBadRequest)
+			writeStatusError(w, http.StatusInternalServerError, estr)
 			return
 		}
-		log.Printf("Prompt used to send to OpenAI %s", prompt)
-		req.Messages[len(req.Messages)-1].Content = prompt
-		handler = ws.chatDefaultStreamHandler
+		w.Header().Set(ContextTokensHeader, strconv.Itoa(tokens))
+		req.Messages = messages
+		handler = ws.ragHandler(conversation, documents)
 	}
 
 	handler(w, req)
 }
 
-func (ws *WebServer) StartWebServer() {
+// metricsHandler serves GET /v1/metrics, the queue depths of the ingestion pipeline
+// and the number of /watch streams.
+func (ws *WebServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := ingest.Metrics{}
+	if ws.Pipeline != nil {
+		metrics = ws.Pipeline.Metrics()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	watchers := 0
+	if ws.Events != nil {
+		watchers = ws.Events.Len()
+	}
+	json.NewEncoder(w).Encode(map[string]any{"ingest": metrics, "watchers": watchers})
+}
+
+// StartWebServer serves the API until ctx is done, then shuts the server down.
+func (ws *WebServer) StartWebServer(ctx context.Context) {
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", ws.Port),
+		Addr:    fmt.Sprintf("%s:%d", ws.Host, ws.Port),
 		Handler: nil,
 	}
 
-	http.HandleFunc("/v1/chat/completions", ws.chatCompletionsHandler)
+	// the chat endpoint checks the scope of the command it receives
+	http.HandleFunc("/v1/chat/completions", ws.authenticated(ws.chatCompletionsHandler))
+	http.HandleFunc("GET /v1/models", ws.authenticated(ws.modelsHandler))
+	http.HandleFunc("POST /v1/embeddings", ws.require(ScopeChat, ws.embeddingsHandler))
+	http.HandleFunc("GET /v1/metrics", ws.require(ScopeRead, ws.metricsHandler))
+	if ws.Pipeline != nil {
+		http.HandleFunc("GET /v1/failures", ws.require(ScopeRead, ws.failuresHandler))
+		http.HandleFunc("POST /v1/failures/retry", ws.require(ScopeAdmin, ws.retryHandler))
+	}
+	http.HandleFunc("GET /v1/sources", ws.require(ScopeRead, ws.sourcesHandler))
+	http.HandleFunc("POST /v1/sources/{name}/{action}", ws.require(ScopeAdmin, ws.sourceActionHandler))
 
 	go func() {
-		log.Printf("Starting server on :%d", ws.Port)
+		log.Printf("Starting server on %s:%d", ws.Host, ws.Port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
 
-	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-
+	<-ctx.Done()
 	log.Println("Shutting down server...")
 
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
+	if err := server.Shutdown(shutdown); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 